@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -331,7 +332,8 @@ func (s *PNServer) handlePushRequest(w http.ResponseWriter, r *http.Request) {
 	if senderValid {
 		limit = fasterRateLimit
 	}
-	if int(now-tokenInfo.LastPushSent) < limit {
+	if wait := limit - int(now-tokenInfo.LastPushSent); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
 		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
@@ -0,0 +1,97 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// tailchatctl sends messages and files to tailchat peers, follows the
+// messages received by the local tailchatd and lists the tailnet peers. It
+// speaks the same line protocol as the app, so it works on headless hosts.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `Usage: tailchatctl [flags] <command> [args]
+
+Commands:
+  send [-port N] [-timeout D] [-tls] <peer> TEXT <message|->
+        Send a text message. The message is sent as is. Use - to read it
+        from stdin.
+  send [-port N] [-timeout D] [-tls] [-name NAME] <peer> FILE <path>
+        Offer a file and send it once the peer accepts it, reporting the
+        progress acknowledged by the peer.
+        With -tls, the peer is reached over TLS and its key is pinned on
+        first use, for peers not on a tailnet.
+  send -queue [-socket PATH] [-name NAME] <peer> TEXT|FILE <message|path>
+        Queue the message or file in the outbox of the local tailchatd,
+        which delivers it once the peer is online. tail shows the delivery
+        status as SEND_STATUS events. Uses the admin socket.
+  send -queue -group ID [-socket PATH] TEXT <message|->
+        Queue the message for each member of the group. tail shows the
+        delivery status per member.
+  tail [-addr ADDR]
+        Subscribe to the local tailchatd and print the messages it receives.
+        Messages buffered while no subscriber was connected are delivered
+        to the first subscriber, which may be tailchatctl. The events are
+        read as JSON from the events port, 50313 by default, with the
+        sequence number and the peer of each.
+  peers [-socket PATH]
+        Print the tailnet peers seen by the local tailchatd. Uses the admin
+        socket.
+
+Flags:
+`
+
+var jsonOutput = flag.Bool("json", false, "Print JSON lines for scripting")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "send":
+		err = runSend(ctx, args)
+	case "tail":
+		err = runTail(ctx, args)
+	case "peers":
+		err = runPeers(ctx, args)
+	default:
+		fmt.Fprintf(os.Stderr, "tailchatctl: unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tailchatctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// printJSON prints v as one JSON line.
+func printJSON(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tailchatctl: %v\n", err)
+		return
+	}
+	fmt.Println(string(data))
+}
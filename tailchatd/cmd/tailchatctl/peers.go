@@ -0,0 +1,112 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+// peer is an entry of the tailchatd peer table.
+type peer struct {
+	Address       string `json:"address,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	FQDN          string `json:"fqdn,omitempty"`
+	MachineName   string `json:"machine_name,omitempty"`
+	TailnetDomain string `json:"tailnet_domain,omitempty"`
+	IsLocal       bool   `json:"is_local,omitempty"`
+	LookupState   string `json:"lookup_state,omitempty"`
+}
+
+// adminClient returns an HTTP client for the tailchatd admin socket.
+func adminClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// adminGet fetches path from the admin API into v.
+func adminGet(ctx context.Context, socket, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://tailchatd"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminClient(socket).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the tailchatd admin socket: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("tailchatd: %v: %s", resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// adminPost posts v as JSON to path on the admin API and decodes the
+// response into result.
+func adminPost(ctx context.Context, socket, path string, v, result any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://tailchatd"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := adminClient(socket).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the tailchatd admin socket: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("tailchatd: %v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func runPeers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("peers", flag.ContinueOnError)
+	flags.BoolVar(jsonOutput, "json", *jsonOutput, "Print JSON lines for scripting")
+	socket := flags.String("socket", "/run/tailchatd/admin.sock", "Admin socket of the local tailchatd")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var peers []peer
+	if err := adminGet(ctx, *socket, "/v1/network", &peers); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		for _, p := range peers {
+			printJSON(p)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tHOSTNAME\tFQDN\tLOCAL\tLOOKUP")
+	for _, p := range peers {
+		local := ""
+		if p.IsLocal {
+			local = "yes"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", p.Address, p.Hostname, p.FQDN, local, p.LookupState)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,354 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shutdownMessage is sent by tailchatd when it is going away.
+const shutdownMessage = "SHUTDOWN:daemon"
+
+// useTLS connects to the peers with TLS.
+var useTLS bool
+
+// offerWait is how long to wait for the peer to accept a file.
+const offerWait = 5 * time.Minute
+
+// errorPrefix starts the error replies of tailchatd, as "ERROR:<id>:<reason>"
+// with the id "daemon" when the connection is rejected.
+const errorPrefix = "ERROR:"
+
+// sendResult is printed with -json when a message or file is delivered.
+type sendResult struct {
+	Event    string `json:"event"` // progress, done or queued
+	ID       string `json:"id"`
+	Peer     string `json:"peer"`
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Received int64  `json:"received,omitempty"`
+	Millis   int64  `json:"ms,omitempty"`
+}
+
+func runSend(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.BoolVar(jsonOutput, "json", *jsonOutput, "Print JSON lines for scripting")
+	port := flags.Int("port", 50311, "Chat port of the peer")
+	timeout := flags.Duration("timeout", 30*time.Second, "How long to wait for the peer to acknowledge")
+	name := flags.String("name", "", "File name to send instead of the base name of the path")
+	flags.BoolVar(&useTLS, "tls", false, "Use TLS with a pinned device key, for peers not on a tailnet")
+	queue := flags.Bool("queue", false, "Queue in the outbox of the local tailchatd, which delivers once the peer is online")
+	socket := flags.String("socket", "/run/tailchatd/admin.sock", "Admin socket of the local tailchatd, for -queue")
+	group := flags.String("group", "", "Queue a TEXT message for the members of the group instead of a peer, with -queue")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *group != "" {
+		if !*queue || flags.NArg() != 2 || !strings.EqualFold(flags.Arg(0), "TEXT") {
+			return errors.New("send: expected -queue -group <id> TEXT <message|->")
+		}
+		message, err := readMessage(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		return queueMessage(ctx, *socket, outboundMessage{Group: *group, Type: "TEXT", Body: message})
+	}
+	if flags.NArg() != 3 {
+		return errors.New("send: expected <peer> TEXT <message|-> or <peer> FILE <path>")
+	}
+	peer := flags.Arg(0)
+	if _, _, err := net.SplitHostPort(peer); err != nil {
+		peer = net.JoinHostPort(peer, strconv.Itoa(*port))
+	}
+
+	switch kind := strings.ToUpper(flags.Arg(1)); kind {
+	case "TEXT":
+		message, err := readMessage(flags.Arg(2))
+		if err != nil {
+			return err
+		}
+		if *queue {
+			return queueMessage(ctx, *socket, outboundMessage{Peer: peer, Type: kind, Body: message})
+		}
+		return sendText(ctx, peer, message, *timeout)
+	case "FILE":
+		if *queue {
+			path, err := filepath.Abs(flags.Arg(2))
+			if err != nil {
+				return err
+			}
+			return queueMessage(ctx, *socket, outboundMessage{Peer: peer, Type: kind, Path: path, Name: *name})
+		}
+		return sendFile(ctx, peer, flags.Arg(2), *name, *timeout)
+	default:
+		return fmt.Errorf("send: unknown message type %q, expected TEXT or FILE", flags.Arg(1))
+	}
+}
+
+// readMessage returns the text message arg, read from stdin if it is -.
+func readMessage(arg string) (string, error) {
+	message := arg
+	if message == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read message: %w", err)
+		}
+		message = strings.TrimRight(string(data), "\n")
+	}
+	if strings.Contains(message, "\n") {
+		return "", errors.New("send: text messages must be a single line")
+	}
+	return message, nil
+}
+
+// peerConn is a connection to the chat port of a peer.
+type peerConn struct {
+	conn    net.Conn
+	peer    string
+	input   *bufio.Reader
+	timeout time.Duration
+}
+
+func dialPeer(ctx context.Context, peer string, timeout time.Duration) (*peerConn, error) {
+	var config *tls.Config
+	if useTLS {
+		var err error
+		if config, err = tlsClientConfig(peer); err != nil {
+			return nil, err
+		}
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %w", peer, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if config != nil {
+		tlsConn := tls.Client(conn, config)
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %v failed: %w", peer, err)
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return &peerConn{conn: conn, peer: peer, input: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// readAck waits for the next ACK of id. It returns done when the peer has
+// handled the message, otherwise the number of bytes it has received.
+func (p *peerConn) readAck(id string) (received int64, done bool, err error) {
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+		line, err := p.input.ReadString('\n')
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read ACK from %v: %w", p.peer, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == shutdownMessage {
+			return 0, false, fmt.Errorf("peer %v is shutting down", p.peer)
+		}
+		if reason, ok := strings.CutPrefix(line, errorPrefix+"daemon:"); ok {
+			return 0, false, fmt.Errorf("peer %v rejected the connection: %v", p.peer, reason)
+		}
+		if reason, ok := strings.CutPrefix(line, errorPrefix+id+":"); ok {
+			return 0, false, fmt.Errorf("peer %v rejected %v: %v", p.peer, id, reason)
+		}
+		rest, ok := strings.CutPrefix(line, "ACK:"+id+":")
+		if !ok {
+			continue // Not for this message.
+		}
+		if rest == "DONE" {
+			return 0, true, nil
+		}
+		received, err = strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid ACK from %v: %q", p.peer, line)
+		}
+		return received, false, nil
+	}
+}
+
+func sendText(ctx context.Context, peer, message string, timeout time.Duration) error {
+	p, err := dialPeer(ctx, peer, timeout)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	id := newID()
+	start := time.Now()
+	if _, err := fmt.Fprintf(p.conn, "TEXT:%s:%s\n", id, message); err != nil {
+		return fmt.Errorf("failed to send to %v: %w", peer, err)
+	}
+	for {
+		_, done, err := p.readAck(id)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	if *jsonOutput {
+		printJSON(sendResult{Event: "done", ID: id, Peer: peer, Type: "TEXT", Millis: time.Since(start).Milliseconds()})
+	} else {
+		fmt.Printf("Sent %v to %v\n", id, peer)
+	}
+	return nil
+}
+
+func sendFile(ctx context.Context, peer, path, name string, timeout time.Duration) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%v is not a regular file", path)
+	}
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	if strings.ContainsAny(name, ":/\n") {
+		return fmt.Errorf("file name must not contain ':', '/' or newlines: %q", name)
+	}
+
+	p, err := dialPeer(ctx, peer, timeout)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	id := newID()
+	size := info.Size()
+	start := time.Now()
+	// Offer the file first and wait for the peer to accept it, which may
+	// ask its user. A tailchatd without offers acknowledges it right away.
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	if _, err := fmt.Fprintf(p.conn, "FILE_OFFER:%s:%s:%d:%s\n", id, name, size, mimeType); err != nil {
+		return fmt.Errorf("failed to send to %v: %w", peer, err)
+	}
+	p.timeout = max(timeout, offerWait)
+	if _, done, err := p.readAck(id); err != nil {
+		return err
+	} else if !done {
+		return fmt.Errorf("unexpected reply from %v to the file offer", peer)
+	}
+	p.timeout = timeout
+	if _, err := fmt.Fprintf(p.conn, "FILE_START:%s:%s:%d\n", id, name, size); err != nil {
+		return fmt.Errorf("failed to send to %v: %w", peer, err)
+	}
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(p.conn, file)
+		copyErr <- err
+	}()
+
+	result := sendResult{ID: id, Peer: peer, Type: "FILE", Name: name, Size: size}
+	for {
+		received, done, err := p.readAck(id)
+		if err != nil {
+			select {
+			case cerr := <-copyErr:
+				if cerr != nil {
+					return fmt.Errorf("failed to send file to %v: %w", peer, cerr)
+				}
+			default:
+			}
+			return err
+		}
+		if done {
+			break
+		}
+		result.Event, result.Received = "progress", received
+		if *jsonOutput {
+			printJSON(result)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%v: %d of %d bytes (%.0f%%)", name, received, size, percent(received, size))
+		}
+	}
+	result.Event, result.Received, result.Millis = "done", size, time.Since(start).Milliseconds()
+	if *jsonOutput {
+		printJSON(result)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%v: %d of %d bytes (100%%)\n", name, size, size)
+		fmt.Printf("Sent %v (%v) to %v\n", name, id, peer)
+	}
+	return nil
+}
+
+// outboundMessage is a message queued in the tailchatd outbox.
+type outboundMessage struct {
+	ID     string `json:"id"`
+	Peer   string `json:"peer"`
+	Type   string `json:"type"`
+	Body   string `json:"body,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// queueMessage hands m to the outbox of the local tailchatd. The delivery
+// status is reported to its subscribers, as shown by tail.
+func queueMessage(ctx context.Context, socket string, m outboundMessage) error {
+	m.ID = newID()
+	var queued outboundMessage
+	if err := adminPost(ctx, socket, "/v1/outbox", m, &queued); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		printJSON(sendResult{Event: "queued", ID: queued.ID, Peer: queued.Peer, Type: queued.Type, Name: queued.Name})
+	} else {
+		to := queued.Peer
+		if queued.Group != "" {
+			to = "group " + queued.Group
+		}
+		fmt.Printf("Queued %v for %v\n", queued.ID, to)
+	}
+	return nil
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// newID returns a random UUID like the message ids of the app.
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,163 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"cylonix.io/tailchatd/events"
+)
+
+// event is a message received from the local tailchatd. Only the fields of
+// its type are set.
+type event struct {
+	Type  string              `json:"type"`
+	Seq   uint64              `json:"seq,omitempty"`
+	ID    string              `json:"id,omitempty"`
+	Peer  string              `json:"peer,omitempty"`  // Address of the peer it came from
+	Body  string              `json:"body,omitempty"`  // TEXT and CTRL
+	Group string              `json:"group,omitempty"` // GROUP_TEXT and GROUP
+	Path  string              `json:"path,omitempty"`  // FILE_END
+	File  *events.FilePayload `json:"file,omitempty"`  // FILE_END from daemons with metadata, and FILE_META
+	Peers []json.RawMessage   `json:"peers,omitempty"` // NETWORK
+}
+
+// parseEvent parses a line from the local tailchatd, a JSON event or a
+// legacy line from a daemon without them.
+func parseEvent(line string) event {
+	var ev *events.Event
+	var err error
+	if events.IsEvent([]byte(line)) {
+		ev, err = events.Decode([]byte(line))
+	} else {
+		ev, err = events.FromLegacy(line)
+	}
+	if err != nil {
+		kind, rest, _ := strings.Cut(line, ":")
+		e := event{Type: kind}
+		e.ID, e.Body, _ = strings.Cut(rest, ":")
+		return e
+	}
+	e := event{Type: ev.Type, Seq: ev.Seq, ID: ev.ID}
+	if ev.Peer != nil {
+		e.Peer = ev.Peer.Address
+	}
+	switch ev.Type {
+	case events.Network:
+		var payload struct {
+			Peers []json.RawMessage `json:"peers"`
+		}
+		if err := ev.DecodePayload(&payload); err != nil {
+			e.Body = string(ev.Payload)
+		}
+		e.Peers = payload.Peers
+	case events.Text, events.Ctrl, events.GroupText:
+		var payload events.MessagePayload
+		ev.DecodePayload(&payload)
+		e.Body, e.Group = payload.Body, payload.Group
+	case events.Group:
+		e.ID, e.Group, e.Body = "", ev.ID, string(ev.Payload)
+	case events.FileEnd, events.FileMeta:
+		var payload events.FilePayload
+		ev.DecodePayload(&payload)
+		e.Path = payload.Path
+		if payload.MIME != "" {
+			e.File = &payload
+		}
+	default:
+		if legacy, err := events.Legacy(ev); err == nil {
+			_, rest, _ := strings.Cut(legacy, ":")
+			_, e.Body, _ = strings.Cut(rest, ":")
+		}
+	}
+	return e
+}
+
+func runTail(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	flags.BoolVar(jsonOutput, "json", *jsonOutput, "Print JSON lines for scripting")
+	addr := flags.String("addr", "127.0.0.1:50313", "Events address of the local tailchatd")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to tailchatd: %w", err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	hello, err := events.New(events.Hello, "", events.HelloPayload{Format: events.FormatJSON, Versions: []int{events.Version}})
+	if err != nil {
+		return err
+	}
+	data, err := events.Encode(hello)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write to tailchatd: %w", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := parseEvent(scanner.Text())
+		if e.Type == events.Hello {
+			continue
+		}
+		if *jsonOutput {
+			printJSON(e)
+		} else {
+			printEvent(e)
+		}
+		if e.Type == events.Shutdown {
+			return fmt.Errorf("tailchatd is shutting down")
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read from tailchatd: %w", err)
+	}
+	return fmt.Errorf("tailchatd closed the connection")
+}
+
+func printEvent(e event) {
+	switch e.Type {
+	case "NETWORK":
+		fmt.Printf("NETWORK %d peers\n", len(e.Peers))
+	case "FILE_END":
+		if e.File == nil {
+			fmt.Printf("FILE_END %v %v\n", e.ID, e.Path)
+		} else if e.File.Width > 0 {
+			fmt.Printf("FILE_END %v %v (%v, %d bytes, %dx%d)\n", e.ID, e.Path, e.File.MIME, e.File.Size, e.File.Width, e.File.Height)
+		} else {
+			fmt.Printf("FILE_END %v %v (%v, %d bytes)\n", e.ID, e.Path, e.File.MIME, e.File.Size)
+		}
+	case "FILE_META":
+		if e.File != nil && e.File.Thumbnail != "" {
+			fmt.Printf("FILE_META %v %v (thumbnail, %d bytes)\n", e.ID, e.Path, len(e.File.Thumbnail))
+		} else {
+			fmt.Printf("FILE_META %v %v\n", e.ID, e.Path)
+		}
+	case "GROUP_TEXT":
+		fmt.Printf("GROUP_TEXT %v [%v] %v\n", e.ID, e.Group, e.Body)
+	case "GROUP":
+		fmt.Printf("GROUP %v %v\n", e.Group, e.Body)
+	default:
+		fmt.Println(strings.TrimSpace(e.Type + " " + e.ID + " " + e.Body))
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"cylonix.io/tailchatd/lantls"
+)
+
+// tlsClientConfig returns the TLS config to connect to peer with. The device
+// key of tailchatctl and the pinned peer keys are kept in the user config
+// directory. The peers are pinned by host.
+func tlsClientConfig(peer string) (*tls.Config, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(configDir, "tailchat")
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := lantls.LoadOrCreateIdentity(dir, hostname)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := lantls.LoadPins(filepath.Join(dir, "known_peers.json"))
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return nil, err
+	}
+	return lantls.ClientConfig(cert, pins, host, func(name, fingerprint string) {
+		fmt.Fprintf(os.Stderr, "Pinned the key of %v: %v\n", name, fingerprint)
+	}), nil
+}
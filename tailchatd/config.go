@@ -0,0 +1,152 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"cylonix.io/tailchatd/server"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "/etc/tailchat/tailchatd.yaml"
+
+var (
+	configPath     = flag.String("config", defaultConfigPath, "Path to the YAML configuration file")
+	port           = flag.Int("port", 50311, "Port to listen on")
+	subscriberPort = flag.Int("subscriber_port", 50312, "Port to listen for subscriber")
+	eventsPort     = flag.Int("events_port", 50313, "Port to listen for subscribers of JSON events")
+	tailnetOnly    = flag.Bool("tailnet_only", false, "Listen for peers on the local tailnet addresses only")
+	dnsServer      = flag.String("dns_server", "", "DNS server (host[:port]) for peer hostname lookups. Defaults to MagicDNS "+server.MagicDNSAddress+" when a tailnet interface exists")
+	dnsTimeout     = flag.Duration("dns_timeout", time.Second, "Timeout of each peer hostname lookup query")
+	metricsListen  = flag.String("metrics_listen", "", "Loopback address to serve Prometheus metrics on, e.g. 127.0.0.1:9311. Disabled if empty")
+	adminSocket    = flag.String("admin_socket", "", "Unix socket to serve the admin API on, e.g. /run/tailchatd/admin.sock. Disabled if empty")
+
+	config atomic.Pointer[Config]
+)
+
+// Config is the daemon configuration loaded from the YAML config file. It is
+// the server config plus the logging options. Command line flags, when set
+// explicitly, take precedence over the file.
+type Config struct {
+	server.Config `yaml:",inline"`
+	Logging       LoggingConfig `yaml:"logging"`
+}
+
+// LoggingConfig holds the logging options.
+type LoggingConfig struct {
+	File       string            `yaml:"file"`       // Empty logs to stdout. Reopened on reload.
+	Format     string            `yaml:"format"`     // text or json.
+	Level      string            `yaml:"level"`      // debug, info, warn or error.
+	Components map[string]string `yaml:"components"` // Per component levels.
+
+	// DebugPayloads logs message bodies, file names and hostnames, which
+	// are redacted otherwise.
+	DebugPayloads bool `yaml:"debug_payloads"`
+
+	level      slog.Level
+	components map[string]slog.Level
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Config: *server.DefaultConfig(),
+		Logging: LoggingConfig{
+			Format: "text",
+			Level:  "info",
+		},
+	}
+}
+
+// loadConfig reads the config file at path on top of the defaults, applies
+// the explicitly set command line flags and validates the result. A missing
+// file at the default path is not an error.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			decoder := yaml.NewDecoder(bytes.NewReader(data))
+			decoder.KnownFields(true)
+			if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("failed to parse config %v: %w", path, err)
+			}
+		case os.IsNotExist(err) && path == defaultConfigPath:
+		default:
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+	}
+	applyFlags(cfg)
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// applyFlags overrides the config with the flags set on the command line.
+func applyFlags(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Listen.Chat = fmt.Sprintf(":%d", *port)
+		case "subscriber_port":
+			cfg.Listen.Subscriber = fmt.Sprintf("127.0.0.1:%d", *subscriberPort)
+		case "events_port":
+			cfg.Listen.Events = fmt.Sprintf("127.0.0.1:%d", *eventsPort)
+		case "tailnet_only":
+			cfg.Listen.TailnetOnly = *tailnetOnly
+		case "dns_server":
+			cfg.Discovery.DNSServer = *dnsServer
+		case "dns_timeout":
+			cfg.Discovery.DNSTimeout = *dnsTimeout
+		case "metrics_listen":
+			cfg.Metrics.Listen = *metricsListen
+		case "admin_socket":
+			cfg.Admin.Socket = *adminSocket
+		case "debug_payloads":
+			cfg.Logging.DebugPayloads = *debugPayloadsFlag
+		}
+	})
+}
+
+func (c *Config) validate() error {
+	return errors.Join(c.Config.Validate(), c.Logging.parseLevels())
+}
+
+// reloadConfig reloads the config file. Settings that can change while
+// running are applied. Changed settings that need a restart are reported by
+// the server and keep their current values until then.
+func reloadConfig(srv *server.Server) {
+	old := config.Load()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		daemonLog.Error("Failed to reload config, keeping the current one", "err", err)
+		return
+	}
+	if err := srv.Reload(&cfg.Config); err != nil {
+		daemonLog.Error("Failed to reload config, keeping the current one", "err", err)
+		return
+	}
+	if err := configureLogging(&cfg.Logging); err != nil {
+		daemonLog.Error("Failed to apply logging config, keeping the current one", "err", err)
+		cfg.Logging = old.Logging
+	}
+	srv.SetDebugPayloads(cfg.Logging.DebugPayloads)
+	if !reflect.DeepEqual(old.Logging, cfg.Logging) {
+		daemonLog.Info("Applied config change", "section", "logging")
+	}
+	cfg.Config = *srv.Config()
+	config.Store(cfg)
+	daemonLog.Info("Config reloaded")
+}
@@ -0,0 +1,350 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package events defines the JSON events of the subscriber port of tailchatd
+// and converts them from and to the legacy string lines. Each event is one
+// line holding an Event, the envelope, with the event specific payload. A
+// subscriber of the events port must send a HELLO event first:
+//
+//	{"v":1,"type":"HELLO","payload":{"format":"json","versions":[1]}}
+//
+// and the daemon answers with its own HELLO before any other event. The
+// commands of the subscribers, SEND, GROUP_SET, READ, ACCEPT and REJECT, are
+// events too. Subscribers of the subscriber port get the legacy lines
+// "<TYPE>:<id>:<body>".
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version is the version of the envelope and the payloads. Fields may be
+// added within a version; anything else changes it.
+const Version = 1
+
+// Formats of the subscriber port.
+const (
+	FormatLegacy = "legacy"
+	FormatJSON   = "json"
+)
+
+// Event types passed to the subscribers.
+const (
+	Hello           = "HELLO"             // HelloPayload. Answers the HELLO of a subscriber.
+	Network         = "NETWORK"           // NetworkPayload.
+	Text            = "TEXT"              // MessagePayload.
+	Ctrl            = "CTRL"              // MessagePayload.
+	GroupText       = "GROUP_TEXT"        // MessagePayload with the group.
+	Group           = "GROUP"             // GroupPayload. The id is the group id.
+	FileEnd         = "FILE_END"          // FilePayload.
+	FileMeta        = "FILE_META"         // FilePayload with the thumbnail, after the FILE_END of the file.
+	FileOffer       = "FILE_OFFER"        // FileOfferPayload.
+	FileOfferClosed = "FILE_OFFER_CLOSED" // ResultPayload: accepted, rejected or timeout.
+	Receipt         = "RECEIPT"           // ReceiptPayload. The id is the message id.
+	SendStatus      = "SEND_STATUS"       // SendStatusPayload.
+	Error           = "ERROR"             // ErrorPayload.
+	Shutdown        = "SHUTDOWN"          // No payload. The id is "daemon".
+)
+
+// Command types sent by the subscribers.
+const (
+	Send     = "SEND"      // SendPayload.
+	GroupSet = "GROUP_SET" // GroupPayload with the name and members. The id is the group id.
+	Read     = "READ"      // No payload. The id is the message shown, the peer the one that sent it.
+	Accept   = "ACCEPT"    // No payload. The id is the file offer.
+	Reject   = "REJECT"    // No payload. The id is the file offer.
+)
+
+// ErrVersion is returned by Decode for an event of another version.
+var ErrVersion = errors.New("unsupported event version")
+
+// Event is the envelope of an event.
+type Event struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq,omitempty"` // Counts the events sent on the connection from 1.
+	Time    time.Time       `json:"time"`          // When the event happened, before any buffering.
+	ID      string          `json:"id,omitempty"`
+	Peer    *Peer           `json:"peer,omitempty"` // The peer the event came from.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Peer identifies the peer an event came from.
+type Peer struct {
+	Address  string `json:"address"`            // Address of the peer connection.
+	Hostname string `json:"hostname,omitempty"` // Hostname in the peer table.
+}
+
+// HelloPayload negotiates the format. The subscriber lists the versions it
+// understands; the daemon answers with the one it chose.
+type HelloPayload struct {
+	Format   string `json:"format"`
+	Versions []int  `json:"versions,omitempty"` // Subscriber only.
+	Version  int    `json:"version,omitempty"`  // Daemon only.
+}
+
+// NetworkPayload is the peer table.
+type NetworkPayload struct {
+	Peers []NetworkPeer `json:"peers"`
+}
+
+// NetworkPeer is a peer in the peer table.
+type NetworkPeer struct {
+	Address       string `json:"address,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	FQDN          string `json:"fqdn,omitempty"`
+	MachineName   string `json:"machine_name,omitempty"`
+	TailnetDomain string `json:"tailnet_domain,omitempty"`
+	IsLocal       bool   `json:"is_local,omitempty"`
+	LookupState   string `json:"lookup_state,omitempty"`
+	Port          int    `json:"port,omitempty"`
+	Source        string `json:"source,omitempty"`
+}
+
+// MessagePayload is a TEXT, CTRL or GROUP_TEXT message.
+type MessagePayload struct {
+	Body  string `json:"body"`
+	Group string `json:"group,omitempty"` // GROUP_TEXT only.
+}
+
+// GroupPayload is a group conversation.
+type GroupPayload struct {
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Members   []string  `json:"members"`
+	Version   int64     `json:"version,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	Updated   time.Time `json:"updated,omitempty"`
+}
+
+// FilePayload describes a received file. Files buffered by older daemons
+// have the path only.
+type FilePayload struct {
+	ID         string    `json:"id,omitempty"`
+	Path       string    `json:"path"`
+	Name       string    `json:"name,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	MIME       string    `json:"mime,omitempty"`
+	Peer       string    `json:"peer,omitempty"`
+	Sender     string    `json:"sender,omitempty"`
+	Started    time.Time `json:"started,omitempty"`
+	Received   time.Time `json:"received,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Thumbnail  string    `json:"thumbnail,omitempty"`
+}
+
+// FileOfferPayload is an incoming file waiting to be accepted or rejected.
+type FileOfferPayload struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	MIME string    `json:"mime"`
+	Peer string    `json:"peer"`
+	Time time.Time `json:"time"`
+}
+
+// ResultPayload is the result of a file offer.
+type ResultPayload struct {
+	Result string `json:"result"`
+}
+
+// ReceiptPayload is a receipt from the receiver of a sent message.
+type ReceiptPayload struct {
+	Status string `json:"status"` // delivered or read
+	Peer   string `json:"peer"`
+}
+
+// SendStatusPayload is the delivery status of a queued message.
+type SendStatusPayload struct {
+	Status   string `json:"status"` // queued, sending, delivered or failed
+	Peer     string `json:"peer,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ErrorPayload rejects a command.
+type ErrorPayload struct {
+	Reason string `json:"reason"`
+}
+
+// SendPayload queues a message or a file for a peer or a group.
+type SendPayload struct {
+	Peer  string `json:"peer,omitempty"`
+	Group string `json:"group,omitempty"`
+	Type  string `json:"type"` // TEXT, CTRL or FILE
+	Body  string `json:"body,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// New returns an event of the current version happening now, with payload
+// marshaled unless it is nil.
+func New(kind, id string, payload any) (*Event, error) {
+	e := &Event{Version: Version, Type: kind, Time: time.Now(), ID: id}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %v payload: %w", kind, err)
+		}
+		e.Payload = data
+	}
+	return e, nil
+}
+
+// Encode returns e as a line without the trailing '\n'.
+func Encode(e *Event) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode parses a line holding an event of the current version.
+func Decode(line []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	if e.Version != Version {
+		return nil, fmt.Errorf("%w: %v", ErrVersion, e.Version)
+	}
+	if e.Type == "" {
+		return nil, errors.New("invalid event: no type")
+	}
+	return &e, nil
+}
+
+// DecodePayload unmarshals the payload of e into v.
+func (e *Event) DecodePayload(v any) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("%v event has no payload", e.Type)
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("invalid %v payload: %w", e.Type, err)
+	}
+	return nil
+}
+
+// IsEvent returns if line holds an event rather than a legacy line.
+func IsEvent(line []byte) bool {
+	return len(line) > 0 && line[0] == '{'
+}
+
+// FromLegacy converts a legacy line "<TYPE>:<id>:<body>" to an event of the
+// current version without the time and the peer.
+func FromLegacy(line string) (*Event, error) {
+	kind, rest, _ := strings.Cut(line, ":")
+	e := &Event{Version: Version, Type: kind}
+	var payload any
+	switch kind {
+	case Network:
+		if json.Valid([]byte(rest)) {
+			e.Payload = json.RawMessage(`{"peers":` + rest + `}`)
+		}
+		return e, nil
+	case GroupText:
+		id, rest, _ := strings.Cut(rest, ":")
+		group, body, _ := strings.Cut(rest, ":")
+		e.ID, payload = id, MessagePayload{Body: body, Group: group}
+	case Text, Ctrl:
+		id, body, _ := strings.Cut(rest, ":")
+		e.ID, payload = id, MessagePayload{Body: body}
+	case FileEnd:
+		id, body, _ := strings.Cut(rest, ":")
+		e.ID = id
+		if IsEvent([]byte(body)) && json.Valid([]byte(body)) {
+			e.Payload = json.RawMessage(body)
+			return e, nil
+		}
+		payload = FilePayload{Path: body}
+	case FileOfferClosed:
+		id, result, _ := strings.Cut(rest, ":")
+		e.ID, payload = id, ResultPayload{Result: result}
+	case Read:
+		id, peer, _ := strings.Cut(rest, ":")
+		e.ID = id
+		if peer != "" {
+			e.Peer = &Peer{Address: peer}
+		}
+		return e, nil
+	case Error:
+		id, reason, _ := strings.Cut(rest, ":")
+		e.ID, payload = id, ErrorPayload{Reason: reason}
+	default:
+		id, body, ok := strings.Cut(rest, ":")
+		e.ID = id
+		if !ok {
+			return e, nil
+		}
+		if !json.Valid([]byte(body)) {
+			return nil, fmt.Errorf("%v line has no JSON body", kind)
+		}
+		e.Payload = json.RawMessage(body)
+		return e, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	e.Payload = data
+	return e, nil
+}
+
+// Legacy converts e to a legacy line. FILE_END is given with the path of the
+// file.
+func Legacy(e *Event) (string, error) {
+	switch e.Type {
+	case Network:
+		var payload struct {
+			Peers json.RawMessage `json:"peers"`
+		}
+		if len(e.Payload) > 0 {
+			if err := e.DecodePayload(&payload); err != nil {
+				return "", err
+			}
+		}
+		if len(payload.Peers) == 0 {
+			payload.Peers = json.RawMessage("null")
+		}
+		return e.Type + ":" + string(payload.Peers), nil
+	case Text, Ctrl, GroupText:
+		var payload MessagePayload
+		if err := e.DecodePayload(&payload); err != nil {
+			return "", err
+		}
+		if e.Type == GroupText {
+			return e.Type + ":" + e.ID + ":" + payload.Group + ":" + payload.Body, nil
+		}
+		return e.Type + ":" + e.ID + ":" + payload.Body, nil
+	case FileEnd:
+		var payload FilePayload
+		if err := e.DecodePayload(&payload); err != nil {
+			return "", err
+		}
+		return e.Type + ":" + e.ID + ":" + payload.Path, nil
+	case FileOfferClosed:
+		var payload ResultPayload
+		if err := e.DecodePayload(&payload); err != nil {
+			return "", err
+		}
+		return e.Type + ":" + e.ID + ":" + payload.Result, nil
+	case Error:
+		var payload ErrorPayload
+		if err := e.DecodePayload(&payload); err != nil {
+			return "", err
+		}
+		return e.Type + ":" + e.ID + ":" + payload.Reason, nil
+	case Read:
+		if e.Peer != nil && e.Peer.Address != "" {
+			return e.Type + ":" + e.ID + ":" + e.Peer.Address, nil
+		}
+	}
+	if len(e.Payload) == 0 {
+		return e.Type + ":" + e.ID, nil
+	}
+	return e.Type + ":" + e.ID + ":" + string(e.Payload), nil
+}
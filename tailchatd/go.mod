@@ -5,7 +5,9 @@ go 1.22.2
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/vishvananda/netlink v1.3.0
+	golang.org/x/net v0.0.0-20220403103023-749bd193bc2b
 	golang.org/x/sys v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/vishvananda/netns v0.0.4 // indirect
@@ -0,0 +1,252 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package lantls implements the optional encrypted transport of the chat
+// port for networks without WireGuard, such as a trusted LAN. Both sides use
+// TLS 1.3 with a self-signed device certificate and pin the key of each peer
+// the first time they see it. A connection starting with a TLS handshake
+// record negotiates TLS; anything else is the plaintext protocol.
+package lantls
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	certFile = "device.crt"
+	keyFile  = "device.key"
+
+	// HandshakeByte is the first byte of a TLS handshake record, which no
+	// plaintext message starts with.
+	HandshakeByte = 0x16
+)
+
+// ErrPinMismatch is returned when a peer presents a key other than the one
+// pinned for it.
+var ErrPinMismatch = errors.New("peer key does not match the pinned key")
+
+// LoadOrCreateIdentity loads the device certificate and key from dir,
+// generating them for name if they do not exist yet.
+func LoadOrCreateIdentity(dir, name string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, certFile)
+	keyPath := filepath.Join(dir, keyFile)
+	cert, err := loadKeyPair(certPath, keyPath)
+	if err == nil {
+		return cert, nil
+	}
+	if !os.IsNotExist(err) {
+		return tls.Certificate{}, fmt.Errorf("failed to load device certificate: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(100, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create device certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return tls.Certificate{}, err
+	}
+	return loadKeyPair(certPath, keyPath)
+}
+
+// loadKeyPair loads the certificate and key with the leaf parsed.
+func loadKeyPair(certPath, keyPath string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil || cert.Leaf != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the public key of cert,
+// which stays the same if the certificate is renewed with the same key.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Pin is the key pinned for a peer.
+type Pin struct {
+	Fingerprint string    `json:"fingerprint"`
+	FirstSeen   time.Time `json:"first_seen"`
+}
+
+// Pins is the set of pinned peer keys, kept as JSON in a file. Remove the
+// entry of a peer from the file to accept its new key.
+type Pins struct {
+	path  string
+	mutex sync.Mutex
+	pins  map[string]Pin
+}
+
+// LoadPins loads the pins from path. A missing file has no pins.
+func LoadPins(path string) (*Pins, error) {
+	p := &Pins{path: path, pins: make(map[string]Pin)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.pins); err != nil {
+		return nil, fmt.Errorf("failed to parse pins %v: %w", path, err)
+	}
+	return p, nil
+}
+
+// Verify checks the key of cert against the one pinned for peer, pinning it
+// if peer is new. It returns true if the key was pinned now.
+func (p *Pins) Verify(peer string, cert *x509.Certificate) (bool, error) {
+	fingerprint := Fingerprint(cert)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pin, ok := p.pins[peer]; ok {
+		if pin.Fingerprint != fingerprint {
+			return false, fmt.Errorf("%w: pinned %v got %v", ErrPinMismatch, pin.Fingerprint, fingerprint)
+		}
+		return false, nil
+	}
+	p.pins[peer] = Pin{Fingerprint: fingerprint, FirstSeen: time.Now()}
+	data, err := json.MarshalIndent(p.pins, "", "  ")
+	if err == nil {
+		err = writeFile(p.path, data)
+	}
+	if err != nil {
+		delete(p.pins, peer)
+		return false, fmt.Errorf("failed to save pin: %w", err)
+	}
+	return true, nil
+}
+
+// ServerConfig returns the config to accept TLS connections with. Peers must
+// present a client certificate, which is pinned by its common name. onPin,
+// if not nil, is called when a new peer is pinned.
+func ServerConfig(cert tls.Certificate, pins *Pins, onPin func(name, fingerprint string)) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			peer, err := parseLeaf(rawCerts)
+			if err != nil {
+				return err
+			}
+			return verify(pins, peer.Subject.CommonName, peer, onPin)
+		},
+	}
+}
+
+// ClientConfig returns the config to connect to peer with TLS. The server
+// certificate is pinned by peer, the address dialed without the port.
+func ClientConfig(cert tls.Certificate, pins *Pins, peer string, onPin func(name, fingerprint string)) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		// The certificates are self-signed. They are checked against the
+		// pins instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			leaf, err := parseLeaf(rawCerts)
+			if err != nil {
+				return err
+			}
+			return verify(pins, peer, leaf, onPin)
+		},
+	}
+}
+
+// PeerName returns the common name of the certificate of the peer of a
+// completed TLS connection.
+func PeerName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func parseLeaf(rawCerts [][]byte) (*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer certificate: %w", err)
+	}
+	// The handshake proves that the peer has the key. Only the key is
+	// trusted, so the rest of the certificate is not checked.
+	return cert, nil
+}
+
+func verify(pins *Pins, peer string, cert *x509.Certificate, onPin func(name, fingerprint string)) error {
+	if peer == "" {
+		return errors.New("peer certificate has no name")
+	}
+	pinned, err := pins.Verify(peer, cert)
+	if err != nil {
+		return err
+	}
+	if pinned && onPin != nil {
+		onPin(peer, Fingerprint(cert))
+	}
+	return nil
+}
+
+// writeFile replaces the file at path with data, readable by the owner only.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
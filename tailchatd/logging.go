@@ -0,0 +1,171 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"cylonix.io/tailchatd/server"
+)
+
+var (
+	debugPayloadsFlag = flag.Bool("debug_payloads", false, "Log message bodies, file names and hostnames. For debugging only")
+
+	logComponents = []string{
+		server.ComponentDaemon,
+		server.ComponentChat,
+		server.ComponentTransfer,
+		server.ComponentSubscriber,
+		server.ComponentNetwork,
+		server.ComponentHook,
+		server.ComponentOutbox,
+	}
+	logBase      atomic.Pointer[slog.Handler]
+	logLevels    sync.Map // component -> *slog.LevelVar
+	defaultLevel = &slog.LevelVar{}
+	logFile      *os.File
+	logMutex     sync.Mutex
+
+	logHandler = &componentHandler{level: defaultLevel}
+	daemonLog  = slog.New(logHandler).With("component", server.ComponentDaemon)
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logBase.Store(&h)
+	for _, component := range logComponents {
+		logLevels.Store(component, &slog.LevelVar{})
+	}
+}
+
+// componentHandler filters records by the level of the component named in
+// the "component" attribute and passes them to the current base handler,
+// which is replaced on config reload.
+type componentHandler struct {
+	level *slog.LevelVar
+	wrap  []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	base := *logBase.Load()
+	for _, wrap := range h.wrap {
+		base = wrap(base)
+	}
+	return base.Handle(ctx, r)
+}
+
+func (h *componentHandler) with(wrap func(slog.Handler) slog.Handler) *componentHandler {
+	c := *h
+	c.wrap = append(c.wrap[:len(c.wrap):len(c.wrap)], wrap)
+	return &c
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := h.with(func(base slog.Handler) slog.Handler { return base.WithAttrs(attrs) })
+	for _, attr := range attrs {
+		if attr.Key != "component" {
+			continue
+		}
+		if v, ok := logLevels.Load(attr.Value.String()); ok {
+			c.level = v.(*slog.LevelVar)
+		}
+	}
+	return c
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithGroup(name) })
+}
+
+// configureLogging applies the logging config: output, format, levels and
+// payload redaction. The log file is reopened so that rotated files are
+// released.
+func configureLogging(cfg *LoggingConfig) error {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	var (
+		f   *os.File
+		out io.Writer = os.Stdout
+	)
+	if cfg.File != "" {
+		var err error
+		f, err = os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		out = f
+	}
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(out, options)
+	} else {
+		h = slog.NewTextHandler(out, options)
+	}
+	logBase.Store(&h)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+
+	for _, component := range logComponents {
+		level := cfg.level
+		if l, ok := cfg.components[component]; ok {
+			level = l
+		}
+		v, _ := logLevels.Load(component)
+		v.(*slog.LevelVar).Set(level)
+	}
+	defaultLevel.Set(cfg.level)
+	if cfg.DebugPayloads {
+		daemonLog.Warn("Payload debugging is on. Message bodies, file names and hostnames are logged")
+	}
+	return nil
+}
+
+// parseLevels validates the levels of the logging config.
+func (c *LoggingConfig) parseLevels() error {
+	if err := c.level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("logging.level: %w", err)
+	}
+	c.components = make(map[string]slog.Level)
+	for component, name := range c.Components {
+		known := false
+		for _, k := range logComponents {
+			known = known || k == component
+		}
+		if !known {
+			return fmt.Errorf("logging.components: unknown component %q, expected one of %v",
+				component, strings.Join(logComponents, ", "))
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("logging.components.%v: %w", component, err)
+		}
+		c.components[component] = level
+	}
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("logging.format must be text or json: %q", c.Format)
+	}
+	return nil
+}
+
+// fatal logs err and exits.
+func fatal(err error) {
+	daemonLog.Error("Exiting", "err", err)
+	os.Exit(1)
+}
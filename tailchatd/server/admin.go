@@ -0,0 +1,322 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Admin API responses.
+type (
+	AdminStatus struct {
+		PID          int       `json:"pid"`
+		Started      time.Time `json:"started"`
+		Uptime       string    `json:"uptime"`
+		Peers        int       `json:"peers"`
+		Subscribers  int       `json:"subscribers"`
+		Transfers    int       `json:"transfers"`
+		Buffered     int       `json:"buffered"`
+		Outbox       int       `json:"outbox"`
+		ShuttingDown bool      `json:"shutting_down"`
+	}
+
+	AdminPeer struct {
+		Remote    string    `json:"remote"`
+		Connected time.Time `json:"connected"`
+		Busy      bool      `json:"busy"`
+		Messages  int       `json:"messages"`
+	}
+
+	AdminSubscriber struct {
+		Remote    string    `json:"remote"`
+		Connected time.Time `json:"connected"`
+	}
+
+	AdminTransfer struct {
+		ID       string    `json:"id"`
+		Name     string    `json:"name"`
+		Size     int64     `json:"size"`
+		Received int64     `json:"received"`
+		Progress float64   `json:"progress"` // 0 to 1.
+		Peer     string    `json:"peer"`
+		Started  time.Time `json:"started"`
+	}
+
+	AdminBuffer struct {
+		Messages []string `json:"messages"`
+	}
+
+	AdminCount struct {
+		Count int `json:"count"`
+	}
+
+	AdminPushDevice struct {
+		ID string `json:"id"`
+	}
+)
+
+func (s *Server) adminPeers() []AdminPeer {
+	s.peerConnMutex.Lock()
+	defer s.peerConnMutex.Unlock()
+	list := make([]AdminPeer, 0, len(s.peerConns))
+	for _, peer := range s.peerConns {
+		peer.mutex.Lock()
+		list = append(list, AdminPeer{
+			Remote:    peer.conn.RemoteAddr().String(),
+			Connected: peer.since,
+			Busy:      peer.busy,
+			Messages:  peer.messages,
+		})
+		peer.mutex.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Connected.Before(list[j].Connected) })
+	return list
+}
+
+func (s *Server) adminSubscribers() []AdminSubscriber {
+	s.subscriberMutex.RLock()
+	defer s.subscriberMutex.RUnlock()
+	list := make([]AdminSubscriber, 0, len(s.subscribers))
+	for conn, sub := range s.subscribers {
+		list = append(list, AdminSubscriber{Remote: conn.RemoteAddr().String(), Connected: sub.since})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Connected.Before(list[j].Connected) })
+	return list
+}
+
+func (s *Server) adminTransfers() []AdminTransfer {
+	list := []AdminTransfer{}
+	for _, t := range s.currentTransfers() {
+		received := t.received.Load()
+		progress := 1.0
+		if t.Size > 0 {
+			progress = float64(received) / float64(t.Size)
+		}
+		list = append(list, AdminTransfer{
+			ID:       t.ID,
+			Name:     t.Name,
+			Size:     t.Size,
+			Received: received,
+			Progress: progress,
+			Peer:     t.Peer,
+			Started:  t.Started,
+		})
+	}
+	return list
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.daemonLog.Error("Failed to write admin response", "err", err)
+	}
+}
+
+// AdminHandler returns the admin API handler. Responses are JSON.
+// Endpoints:
+//
+//	GET  /v1/status                  daemon status and counts
+//	GET  /v1/peers                   active peer connections
+//	GET  /v1/subscribers             connected subscribers
+//	GET  /v1/transfers               in-progress file transfers
+//	POST /v1/transfers/{id}/cancel   cancel the transfers with id
+//	GET  /v1/buffer                  messages buffered for subscribers
+//	POST /v1/buffer/flush            drop the buffered messages
+//	GET  /v1/network                 the tailnet peer table
+//	POST /v1/network/rescan          rescan the tailnet peers
+//	GET  /v1/outbox                  messages queued for the peers
+//	POST /v1/outbox                  queue a JSON OutboundMessage
+//	POST /v1/outbox/{id}/cancel      drop the queued messages with id
+//	GET  /v1/push/devices            push device UUIDs by peer name
+//	PUT  /v1/push/devices/{peer}     set the push device of peer to {"id"}
+//	DELETE /v1/push/devices/{peer}   remove the push device of peer
+//	GET  /v1/groups                  the group conversations
+//	GET  /v1/groups/{id}             the group with id
+//	PUT  /v1/groups/{id}             create or change a group to {"name", "members"}
+//	GET  /v1/offers                  file offers waiting for consent
+//	POST /v1/offers/{id}/accept      accept the file offer with id
+//	POST /v1/offers/{id}/reject      reject the file offer with id
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		buffered, _ := s.bufferStats()
+		s.writeJSON(w, AdminStatus{
+			PID:          os.Getpid(),
+			Started:      s.started,
+			Uptime:       time.Since(s.started).Round(time.Second).String(),
+			Peers:        len(s.adminPeers()),
+			Subscribers:  len(s.adminSubscribers()),
+			Transfers:    len(s.currentTransfers()),
+			Buffered:     buffered,
+			Outbox:       s.outbox.len(),
+			ShuttingDown: s.shutdownCtx.Err() != nil,
+		})
+	})
+	mux.HandleFunc("GET /v1/peers", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.adminPeers())
+	})
+	mux.HandleFunc("GET /v1/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.adminSubscribers())
+	})
+	mux.HandleFunc("GET /v1/transfers", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.adminTransfers())
+	})
+	mux.HandleFunc("POST /v1/transfers/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		n := s.cancelTransfers(id)
+		if n == 0 {
+			http.Error(w, "No such transfer", http.StatusNotFound)
+			return
+		}
+		s.transferLog.Info("Transfer canceled by admin", "id", id)
+		s.writeJSON(w, AdminCount{Count: n})
+	})
+	mux.HandleFunc("GET /v1/buffer", func(w http.ResponseWriter, r *http.Request) {
+		s.bufferMutex.Lock()
+		messages := s.loadBufferedMessagesLocked()
+		s.bufferMutex.Unlock()
+		if messages == nil {
+			messages = []string{}
+		}
+		s.writeJSON(w, AdminBuffer{Messages: messages})
+	})
+	mux.HandleFunc("POST /v1/buffer/flush", func(w http.ResponseWriter, r *http.Request) {
+		s.bufferMutex.Lock()
+		n := len(s.loadBufferedMessagesLocked())
+		if n > 0 {
+			s.clearBufferLocked()
+		}
+		s.bufferMutex.Unlock()
+		s.subscriberLog.Info("Buffered messages flushed by admin", "count", n)
+		s.writeJSON(w, AdminCount{Count: n})
+	})
+	mux.HandleFunc("GET /v1/network", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.discovery.Peers())
+	})
+	mux.HandleFunc("POST /v1/network/rescan", func(w http.ResponseWriter, r *http.Request) {
+		s.networkLog.Info("Rescan requested by admin")
+		s.discovery.Rescan()
+		s.writeJSON(w, s.discovery.Peers())
+	})
+	mux.HandleFunc("GET /v1/outbox", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.outbox.list())
+	})
+	mux.HandleFunc("POST /v1/outbox", func(w http.ResponseWriter, r *http.Request) {
+		var m OutboundMessage
+		if err := json.NewDecoder(io.LimitReader(r.Body, subscriberMaxLineSize)).Decode(&m); err != nil {
+			http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		queued, err := s.outbox.enqueue(m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, queued)
+	})
+	mux.HandleFunc("POST /v1/outbox/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		n := s.outbox.cancelMessage(r.PathValue("id"))
+		if n == 0 {
+			http.Error(w, "No such message", http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, AdminCount{Count: n})
+	})
+	mux.HandleFunc("GET /v1/push/devices", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.push.list())
+	})
+	mux.HandleFunc("PUT /v1/push/devices/{peer}", func(w http.ResponseWriter, r *http.Request) {
+		var device AdminPushDevice
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&device); err != nil || device.ID == "" {
+			http.Error(w, "Invalid device: expected {\"id\": \"<uuid>\"}", http.StatusBadRequest)
+			return
+		}
+		if err := s.push.setDevice(r.PathValue("peer"), device.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, s.push.list())
+	})
+	mux.HandleFunc("DELETE /v1/push/devices/{peer}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.push.setDevice(r.PathValue("peer"), ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, s.push.list())
+	})
+	mux.HandleFunc("GET /v1/groups", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.groups.list())
+	})
+	mux.HandleFunc("GET /v1/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		group, ok := s.groups.get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "No such group", http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, group)
+	})
+	mux.HandleFunc("PUT /v1/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var group Group
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&group); err != nil {
+			http.Error(w, "Invalid group: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		group.ID = r.PathValue("id")
+		group, err := s.groups.set(group)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, group)
+	})
+	mux.HandleFunc("GET /v1/offers", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.offers.list())
+	})
+	mux.HandleFunc("POST /v1/offers/{id}/{decision}", func(w http.ResponseWriter, r *http.Request) {
+		decision := r.PathValue("decision")
+		if decision != "accept" && decision != "reject" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := s.offers.decide(r.PathValue("id"), decision == "accept"); err != nil {
+			http.Error(w, "No such offer", http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, AdminCount{Count: 1})
+	})
+	return mux
+}
+
+// serveAdmin serves the admin API on the Unix socket at path. A stale socket
+// left by a previous run is replaced. The socket is only accessible by the
+// daemon user.
+func (s *Server) serveAdmin(path string) (io.Closer, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale admin socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for admin: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set admin socket permissions: %w", err)
+	}
+	server := &http.Server{Handler: s.AdminHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		s.daemonLog.Info("Starting admin server", "socket", path)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.daemonLog.Error("Admin server stopped", "err", err)
+		}
+	}()
+	return server, nil
+}
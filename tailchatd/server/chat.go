@@ -0,0 +1,606 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message passed among functions are without the trailing '\n'
+
+const (
+	fileStartPrefix = "FILE_START:"
+
+	// spliceMaxChunk limits the file data moved with splice between the
+	// checks for progress ACKs, shutdown and cancel.
+	spliceMaxChunk = 16 * 1024 * 1024
+)
+
+func (s *Server) handleConnection(conn net.Conn, limiter *peerLimiter) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	s.chatLog.Info("New client connected", "remote", remote)
+	peer, ok := s.trackPeerConn(conn)
+	if !ok {
+		conn.Write([]byte(shutdownMessage + "\n"))
+		return
+	}
+	defer s.untrackPeerConn(peer)
+
+	negotiated, err := s.negotiate(conn)
+	if err != nil {
+		if errors.Is(err, errTLSRequired) {
+			s.chatLog.Warn("Plaintext connection refused", "remote", remote)
+			s.metrics.connectionErrors.Inc(rejectTLSRequired)
+			conn.Write([]byte(errorMessage("daemon", rejectTLSRequired) + "\n"))
+			return
+		}
+		s.chatLog.Warn("Failed to negotiate the connection", "remote", remote, "err", err)
+		s.metrics.connectionErrors.Inc("negotiate")
+		return
+	}
+	conn = negotiated
+	s.outbox.wakeHost(remoteAddr(conn).String())
+
+	fileBufferSize := s.Config().Buffer.FileBufferSize
+	input := bufio.NewReaderSize(&limitedReader{r: conn, limiter: limiter, ctx: s.drainCtx}, fileBufferSize)
+	output := newPeerWriter(conn, s.Config().Limits.WriteTimeout)
+	defer output.close()
+
+	var fullBuffer []byte
+	var lineStart time.Time
+	readBuffer := make([]byte, fileBufferSize)
+	s.chatLog.Debug("Starting message loop", "remote", remote)
+	for {
+		limits := &s.Config().Limits
+		m := bytes.IndexAny(fullBuffer, "\n")
+		line := fullBuffer
+		if m >= 0 {
+			line = fullBuffer[:m]
+		}
+		if limits.lineTooLong(line) {
+			s.chatLog.Warn("Message too large. Closing", "remote", remote, "len", len(line))
+			s.metrics.connectionErrors.Inc(rejectMessageTooLarge)
+			replyError(output, "daemon", rejectMessageTooLarge)
+			break
+		}
+		if m >= 0 {
+			// Got one message. Handle the message.
+			message := string(fullBuffer[:m])
+			fullBuffer = fullBuffer[m+1:] // Skip the '\n'
+			s.chatLog.Debug("Got message", "remote", remote, "len", m, "buffered", len(fullBuffer))
+			parts := strings.Split(message, ":")
+			if len(parts) < 2 {
+				s.chatLog.Warn("Invalid message format", "remote", remote, s.messageAttr(message))
+				s.metrics.connectionErrors.Inc("invalid_message")
+				break
+			}
+
+			id := parts[1]
+			if !limiter.allowMessage() {
+				s.chatLog.Warn("Message rate limit exceeded", "remote", remote, s.messageAttr(message))
+				s.metrics.admissionRejections.Inc(rejectMessageRate)
+				replyError(output, id, rejectMessageRate)
+				if strings.HasPrefix(message, fileStartPrefix) {
+					// The file data follows and cannot be skipped.
+					break
+				}
+				continue
+			}
+			kind, dedup := deduplicated(message)
+			if dedup && kind != "FILE_START" && s.dedup.seen(remoteAddr(conn), id) {
+				// Retried by the peer after a lost ACK. The file data of a
+				// FILE_START follows, so it is skipped by handleFileTransfer.
+				s.chatLog.Info("Duplicate message. Acknowledging", "remote", remote, "type", kind, "id", id)
+				s.metrics.duplicateMessages.Inc(kind)
+				if err := output.send("ACK:" + id + ":DONE"); err != nil {
+					s.chatLog.Error("Failed to write ACK", "remote", remote, "err", err)
+					s.metrics.connectionErrors.Inc("write")
+					break
+				}
+				continue
+			}
+			peer.setBusy(true)
+			fullBuffer, err = s.handleMessage(conn, input, output, message, fullBuffer)
+			var rejected *rejectedError
+			if errors.As(err, &rejected) {
+				s.chatLog.Warn("Message rejected", "remote", remote, "reason", rejected.reason)
+				s.metrics.messagesRejected.Inc(rejected.reason)
+				replyError(output, id, rejected.reason)
+				if peer.setBusy(false) {
+					sayGoodbye(output)
+					break
+				}
+				continue
+			}
+			if err != nil {
+				s.chatLog.Error("Error handling message", "remote", remote, "err", err)
+				s.metrics.connectionErrors.Inc("handle_message")
+				if errors.Is(err, errTransferInterrupted) {
+					sayGoodbye(output)
+				}
+				if errors.Is(err, errTransferStalled) {
+					s.metrics.connectionErrors.Inc(rejectTransferStalled)
+					replyError(output, id, rejectTransferStalled)
+				}
+				var rejectedFile *fileRejectedError
+				if errors.As(err, &rejectedFile) {
+					// The file data follows and cannot be skipped.
+					s.metrics.connectionErrors.Inc(rejectedFile.reason)
+					replyError(output, id, rejectedFile.reason)
+				}
+				break
+			}
+			s.chatLog.Debug("Done handling message", "remote", remote, s.messageAttr(message))
+			if dedup {
+				s.dedup.add(remoteAddr(conn), id)
+			}
+			if err := output.send("ACK:" + id + ":DONE"); err != nil {
+				s.chatLog.Error("Failed to write ACK", "remote", remote, "err", err)
+				s.metrics.connectionErrors.Inc("write")
+				break
+			}
+			if peer.setBusy(false) {
+				sayGoodbye(output)
+				break
+			}
+			continue
+		}
+		// Wait for the next message at most the idle timeout and for the rest
+		// of a started message at most the header timeout since its start.
+		// The deadline is set before checking for shutdown so that it does
+		// not override the one set to interrupt the read.
+		var deadline time.Time
+		if len(fullBuffer) == 0 {
+			lineStart = time.Time{}
+			if limits.IdleTimeout > 0 {
+				deadline = time.Now().Add(limits.IdleTimeout)
+			}
+		} else {
+			if lineStart.IsZero() {
+				lineStart = time.Now()
+			}
+			if limits.HeaderTimeout > 0 {
+				deadline = lineStart.Add(limits.HeaderTimeout)
+			}
+		}
+		conn.SetReadDeadline(deadline)
+		if s.shutdownCtx.Err() != nil {
+			sayGoodbye(output)
+			break
+		}
+		if err := output.Err(); err != nil {
+			s.chatLog.Error("Failed to write to remote", "remote", remote, "err", err)
+			s.metrics.connectionErrors.Inc("write")
+			break
+		}
+		s.chatLog.Debug("Reading from remote", "remote", remote)
+		n, err := input.Read(readBuffer)
+		if err != nil {
+			if s.shutdownCtx.Err() != nil {
+				sayGoodbye(output)
+				break
+			}
+			if err := output.Err(); err != nil {
+				s.chatLog.Error("Failed to write to remote", "remote", remote, "err", err)
+				s.metrics.connectionErrors.Inc("write")
+				break
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				reason := rejectIdleTimeout
+				if len(fullBuffer) > 0 {
+					reason = rejectHeaderTimeout
+				}
+				s.chatLog.Warn("Read timed out. Closing", "remote", remote, "reason", reason)
+				s.metrics.connectionErrors.Inc(reason)
+				replyError(output, "daemon", reason)
+				break
+			}
+			if err != io.EOF {
+				s.chatLog.Error("Error reading message", "remote", remote, "err", err)
+				s.metrics.connectionErrors.Inc("read")
+			} else {
+				s.chatLog.Info("EOF received", "remote", remote)
+			}
+			break
+		}
+		if n <= 0 {
+			// No error but no bytes read? Not expected.
+			s.chatLog.Error("Empty read without error. Unexpected. Close", "remote", remote)
+			s.metrics.connectionErrors.Inc("read")
+			break
+		}
+		fullBuffer = append(fullBuffer, readBuffer[:n]...)
+	}
+	s.chatLog.Info("Done with client", "remote", remote)
+}
+
+// replyError sends an error reply for the message id, or "daemon" for the
+// connection, to the peer.
+func replyError(output *peerWriter, id, reason string) {
+	output.send(errorMessage(id, reason))
+}
+
+// sayGoodbye tells the peer that the daemon is shutting down.
+func sayGoodbye(output *peerWriter) {
+	output.send(shutdownMessage)
+}
+
+func (s *Server) handleMessage(conn net.Conn, input *bufio.Reader, output *peerWriter, message string, fullBuffer []byte) ([]byte, error) {
+	message = strings.TrimSuffix(message, "\n")
+	s.chatLog.Info("Received message", s.messageAttr(message))
+	switch {
+	case strings.HasPrefix(message, "TEXT:") || strings.HasPrefix(message, "CTRL:"):
+		s.metrics.messagesReceived.Inc(message[:4])
+		parts := strings.SplitN(message, ":", 3)
+		m := Message{Type: parts[0], ID: parts[1], Peer: conn.RemoteAddr().String()}
+		if len(parts) > 2 {
+			m.Body = parts[2]
+		}
+		if m.Type == "TEXT" && s.push.learn(conn, m.Body) {
+			return fullBuffer, nil
+		}
+		e, err := s.peerEvent(conn, message)
+		if err != nil {
+			return fullBuffer, err
+		}
+		s.receipts.track(m.ID, conn, "")
+		s.broadcastOrBufferEvent(e)
+		s.hooks.dispatch(&HookEvent{Type: m.Type, ID: m.ID, Body: m.Body, Peer: m.Peer, Time: time.Now()})
+		if s.opts.OnMessage != nil {
+			s.opts.OnMessage(m)
+		}
+	case strings.HasPrefix(message, groupTextPrefix):
+		parts := strings.SplitN(message, ":", 4)
+		if len(parts) < 4 {
+			return fullBuffer, &rejectedError{rejectInvalidGroup}
+		}
+		m := Message{Type: "TEXT", ID: parts[1], Group: parts[2], Body: parts[3], Peer: conn.RemoteAddr().String()}
+		if err := s.groups.checkSender(m.Group, remoteAddr(conn)); err != nil {
+			return fullBuffer, err
+		}
+		s.metrics.messagesReceived.Inc("GROUP_TEXT")
+		e, err := s.peerEvent(conn, message)
+		if err != nil {
+			return fullBuffer, err
+		}
+		s.receipts.track(m.ID, conn, m.Group)
+		s.broadcastOrBufferEvent(e)
+		s.hooks.dispatch(&HookEvent{Type: m.Type, ID: m.ID, Body: m.Body, Peer: m.Peer, Time: time.Now(), Group: m.Group})
+		if s.opts.OnMessage != nil {
+			s.opts.OnMessage(m)
+		}
+	case strings.HasPrefix(message, groupSyncPrefix):
+		parts := strings.SplitN(message, ":", 3)
+		if len(parts) < 3 {
+			return fullBuffer, &rejectedError{rejectInvalidGroup}
+		}
+		s.metrics.messagesReceived.Inc("GROUP_SYNC")
+		if err := s.groups.receiveSync(remoteAddr(conn), parts[2]); err != nil {
+			return fullBuffer, err
+		}
+	case strings.HasPrefix(message, receiptPrefix):
+		s.metrics.messagesReceived.Inc("RECEIPT")
+		if err := s.handleReceipt(conn, message); err != nil {
+			return fullBuffer, err
+		}
+	case strings.HasPrefix(message, fileOfferPrefix):
+		s.metrics.messagesReceived.Inc("FILE_OFFER")
+		if err := s.offers.handleOffer(conn, message[len(fileOfferPrefix):]); err != nil {
+			return fullBuffer, err
+		}
+	case strings.HasPrefix(message, fileStartPrefix):
+		s.metrics.messagesReceived.Inc("FILE_START")
+		return s.handleFileTransfer(conn, input, output, message[len(fileStartPrefix):], fullBuffer)
+	case strings.HasPrefix(message, "PING"):
+		s.metrics.messagesReceived.Inc("PING")
+		s.chatLog.Debug("Got ping message")
+		// TODO: respond with Pong
+	default:
+		s.metrics.messagesReceived.Inc("unknown")
+		s.chatLog.Warn("Unrecognized message type", s.messageAttr(message))
+	}
+	return fullBuffer, nil
+}
+
+func (s *Server) handleFileTransfer(conn net.Conn, input *bufio.Reader, output *peerWriter, startMessage string, fullBuffer []byte) ([]byte, error) {
+	parts := strings.Split(startMessage, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid file start message format: %v", s.messageAttr(fileStartPrefix+startMessage).Value)
+	}
+
+	id := parts[0]
+	fileName := parts[1]
+	fileSize, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file size %v: %w", fileSize, err)
+	}
+	if !validFileName(fileName) {
+		return nil, &fileRejectedError{rejectInvalidName}
+	}
+	s.transferLog.Info("File transfer", "id", id, "name", s.sensitive(fileName), "size", fileSize)
+	cfg := s.Config()
+	if err := s.checkQuota(&cfg.Quota, fileSize); err != nil {
+		return nil, fmt.Errorf("file %v rejected: %w", id, err)
+	}
+	fileBufferSize := cfg.Buffer.FileBufferSize
+	ackInterval := cfg.Buffer.AckInterval
+
+	// Receive into a partial file that is committed once complete. It is
+	// kept with a checkpoint if the transfer is interrupted by shutdown. A
+	// file received again is read and dropped.
+	var file IncomingFile = discardFile{}
+	duplicate := s.dedup.seen(remoteAddr(conn), id)
+	if duplicate {
+		s.transferLog.Info("Duplicate file. Discarding", "id", id, "name", s.sensitive(fileName))
+		s.metrics.duplicateMessages.Inc("FILE_START")
+	} else {
+		if err := s.admitFile(conn, id, fileName, fileSize); err != nil {
+			return nil, err
+		}
+		if file, err = s.storage.CreateFile(fileName); err != nil {
+			return nil, fmt.Errorf("failed to create file for %v: %w", id, s.redactPath(err))
+		}
+	}
+	t := s.trackTransfer(conn, id, fileName, fileSize)
+
+	var (
+		extra    []byte
+		received int64 = 0
+		buffer         = make([]byte, fileBufferSize)
+		writer         = bufio.NewWriterSize(file, fileBufferSize)
+		closed   bool
+		result   = "error"
+	)
+	defer func() {
+		s.untrackTransfer(t)
+		s.metrics.transferBytes.Add(float64(received))
+		s.metrics.transfers.Inc(result)
+		if !closed {
+			file.Abort()
+		}
+	}()
+
+	s.transferLog.Debug("File created. Starting receiving file", "id", id)
+	start := time.Now()
+	finish := func() error {
+		if err := s.untrackTransfer(t); err != nil {
+			result = "canceled"
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("failed to write to file: %w", err)
+		}
+		closed = true
+		if duplicate {
+			result = "duplicate"
+			return nil
+		}
+		filePath, err := file.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit file for %v: %w", id, s.redactPath(err))
+		}
+		result = "ok"
+		s.metrics.transferDuration.ObserveSince(start)
+		delta := time.Since(start).Milliseconds()
+		s.transferLog.Info("Completed file receiving. Notify APP", "id", id, "size", fileSize, "ms", delta)
+		s.receipts.track(id, conn, "")
+		return s.notifyFile(&FileMetadata{
+			ID:         id,
+			Path:       filePath,
+			Name:       fileName,
+			Size:       fileSize,
+			Peer:       conn.RemoteAddr().String(),
+			Sender:     s.peerHostname(remoteAddr(conn)),
+			Started:    start,
+			Received:   time.Now(),
+			DurationMS: delta,
+		}, s.peerIdentity(conn))
+	}
+	checkpoint := func() error {
+		result = "interrupted"
+		err := writer.Flush()
+		if err == nil {
+			closed = true
+			err = file.Checkpoint(&TransferCheckpoint{
+				ID:       id,
+				Name:     fileName,
+				Size:     fileSize,
+				Received: received,
+				Peer:     conn.RemoteAddr().String(),
+				Time:     time.Now(),
+			})
+		}
+		if err != nil {
+			s.transferLog.Error("Failed to checkpoint interrupted transfer", "id", id, "name", s.sensitive(fileName), "err", s.redactPath(err))
+		}
+		return fmt.Errorf("%w: received=%v of %v", errTransferInterrupted, received, fileSize)
+	}
+	alreadyRead := len(fullBuffer)
+	if int64(alreadyRead) >= fileSize {
+		_, err = writer.Write(fullBuffer[:fileSize])
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to file: %w", err)
+		}
+		received = fileSize
+		t.received.Store(received)
+		if err := finish(); err != nil {
+			return nil, err
+		}
+		return fullBuffer[int(fileSize):], nil
+	}
+	if alreadyRead > 0 {
+		_, err = writer.Write(fullBuffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to file %w", err)
+		}
+		fullBuffer = nil
+		received = int64(alreadyRead)
+		t.received.Store(received)
+	}
+
+	// Over plain TCP, the kernel moves the rest of the data from the socket
+	// to the file with splice, in chunks that grow while they take less than
+	// the ACK interval so that progress is still acknowledged. The chunks are
+	// copied in steps of the buffer size, each with a new stall deadline, so
+	// that a slow link is not taken for a stalled one.
+	src := s.spliceSource(conn, input)
+	chunk := int64(fileBufferSize)
+	if src != nil {
+		if err := writer.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to write to file: %w", err)
+		}
+		s.transferLog.Debug("Receiving file with splice", "id", id)
+	}
+	ack := time.Now().Add(ackInterval)
+	setStallDeadline := func() {
+		var deadline time.Time
+		if stall := s.Config().Limits.StallTimeout; stall > 0 {
+			deadline = time.Now().Add(stall)
+		}
+		conn.SetReadDeadline(deadline)
+	}
+	for received < fileSize {
+		// Shutdown and cancel interrupt the read with a past deadline, so
+		// check them after setting the stall deadline.
+		setStallDeadline()
+		if s.drainCtx.Err() != nil {
+			return nil, checkpoint()
+		}
+		if s.transferCanceled(t) {
+			result = "canceled"
+			return nil, fmt.Errorf("%w: received=%v of %v", errTransferCanceled, received, fileSize)
+		}
+		if err := output.Err(); err != nil {
+			return nil, fmt.Errorf("failed to write ack: %w", err)
+		}
+		var n int
+		var err error
+		if src != nil {
+			chunkStart := time.Now()
+			chunkEnd := received + min(fileSize-received, chunk)
+			for {
+				var copied int64
+				copied, err = io.CopyN(file, src, min(chunkEnd-received, int64(fileBufferSize)))
+				received += copied
+				t.received.Store(received)
+				if err != nil || received == chunkEnd {
+					break
+				}
+				setStallDeadline()
+				if s.drainCtx.Err() != nil || s.transferCanceled(t) {
+					break
+				}
+			}
+			if time.Since(chunkStart) < ackInterval {
+				chunk = min(chunk*2, spliceMaxChunk)
+			} else {
+				chunk = max(chunk/2, int64(fileBufferSize))
+			}
+		} else {
+			n, err = input.Read(buffer)
+		}
+		if err != nil {
+			// Splice reports the deadline as a write error on the file.
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if s.drainCtx.Err() != nil {
+					return nil, checkpoint()
+				}
+				if s.transferCanceled(t) {
+					result = "canceled"
+					return nil, fmt.Errorf("%w: received=%v of %v", errTransferCanceled, received, fileSize)
+				}
+				if err := output.Err(); err != nil {
+					return nil, fmt.Errorf("failed to write ack: %w", err)
+				}
+				result = "stalled"
+				return nil, fmt.Errorf("%w: received=%v of %v", errTransferStalled, received, fileSize)
+			}
+			if err != io.EOF {
+				return nil, fmt.Errorf("failed to read from socket: received=%v: %w", received, err)
+			}
+			if received < fileSize {
+				return nil, fmt.Errorf("received EOF before finishing received=%v n=%v", received, n)
+			}
+			s.transferLog.Debug("EOF received. Finish file receiving", "id", id, "n", n)
+			break
+		}
+		now := time.Now()
+		if now.After(ack) {
+			ack = now.Add(ackInterval)
+			if err := output.sendProgress(fmt.Sprintf("ACK:%v:%v", id, received)); err != nil {
+				return nil, fmt.Errorf("failed to write ack: %w", err)
+			}
+			s.transferLog.Debug("File progress", "id", id, "received", received, "size", fileSize)
+		}
+		if src != nil {
+			continue
+		}
+		if int64(n)+received > fileSize {
+			m := int(fileSize - received)
+			extra = buffer[m:n]
+			n = m
+		}
+		_, err = writer.Write(buffer[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to file: %w", err)
+		}
+		received += int64(n)
+		t.received.Store(received)
+		if received == fileSize {
+			s.transferLog.Debug("File received all", "id", id, "size", fileSize)
+			break
+		}
+	}
+
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return extra, nil
+}
+
+// spliceSource returns the TCP connection to copy the file data from with
+// splice, or nil if it must be read through input: over TLS, with a byte
+// rate limit or with data already buffered.
+func (s *Server) spliceSource(conn net.Conn, input *bufio.Reader) *net.TCPConn {
+	if input.Buffered() > 0 || s.Config().Limits.BytesPerSecond > 0 {
+		return nil
+	}
+	if sniffed, ok := conn.(*sniffedConn); ok {
+		if sniffed.r.Buffered() > 0 {
+			return nil
+		}
+		conn = sniffed.Conn
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
+
+// checkQuota returns an error if storing a file of fileSize bytes would
+// exceed the quotas.
+func (s *Server) checkQuota(quota *QuotaConfig, fileSize int64) error {
+	if quota.MaxFileSize > 0 && fileSize > quota.MaxFileSize {
+		return fmt.Errorf("file size %d exceeds the limit of %d", fileSize, quota.MaxFileSize)
+	}
+	if quota.MaxCacheSize <= 0 {
+		return nil
+	}
+	used, err := s.storage.Usage()
+	if err != nil {
+		return fmt.Errorf("failed to check cache usage: %w", s.redactPath(err))
+	}
+	if used+fileSize > quota.MaxCacheSize {
+		return fmt.Errorf("cache usage %d plus file size %d exceeds the limit of %d", used, fileSize, quota.MaxCacheSize)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleConnectionReplies(t *testing.T) {
+	s := newTestServer(t, nil)
+	var mutex sync.Mutex
+	var messages []string
+	s.opts.OnMessage = func(m Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		messages = append(messages, m.Type+":"+m.ID+":"+m.Body)
+	}
+	peer := dialTestPeer(t, serveTestChat(t, s))
+
+	// Pipelined, with a resent TEXT and a file following in the same write.
+	peer.write("TEXT:t1:hello\nCTRL:c1:typing\nGROUP_TEXT:g1\nTEXT:t1:hello\nTEXT:t2:again\nFILE_START:f1:a.txt:5\nabcde")
+	for _, want := range []string{
+		"ACK:t1:DONE",
+		"ACK:c1:DONE",
+		errorMessage("g1", rejectInvalidGroup),
+		"ACK:t1:DONE",
+		"ACK:t2:DONE",
+		"ACK:f1:DONE",
+	} {
+		if reply := peer.reply(); reply != want {
+			t.Fatalf("reply = %q, want %q", reply, want)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// The resent t1 is acknowledged but not passed on again.
+	if got, want := strings.Join(messages, ","), "TEXT:t1:hello,CTRL:c1:typing,TEXT:t2:again"; got != want {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+}
+
+func TestHandleConnectionConcurrentPeers(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.MessagesPerSecond = 0
+		cfg.Limits.MaxConnectionsPerIP = 0
+		cfg.Buffer.AckInterval = time.Millisecond
+	})
+	s.opts.OnFileReceived = func(f ReceivedFile) { os.Remove(f.Path) }
+	addr := serveTestChat(t, s)
+	data := string(bytes.Repeat([]byte("x"), 1<<20))
+
+	t.Run("peers", func(t *testing.T) {
+		for p := 0; p < 8; p++ {
+			p := p
+			t.Run(fmt.Sprint(p), func(t *testing.T) {
+				t.Parallel()
+				peer := dialTestPeer(t, addr)
+				for i := 0; i < 20; i++ {
+					id := fmt.Sprintf("p%d-%d", p, i)
+					peer.write(fmt.Sprintf("TEXT:%s-t:hi\nCTRL:%s-c:typing\nGROUP_TEXT:%s-g\n", id, id, id))
+					peer.write(fmt.Sprintf("FILE_START:%s-f:%s.bin:%d\n%s", id, id, len(data), data))
+					for _, want := range []string{
+						"ACK:" + id + "-t:DONE",
+						"ACK:" + id + "-c:DONE",
+						errorMessage(id+"-g", rejectInvalidGroup),
+						"ACK:" + id + "-f:DONE",
+					} {
+						if reply := peer.reply(); reply != want {
+							t.Fatalf("reply = %q, want %q", reply, want)
+						}
+					}
+				}
+				// No progress of the last file follows its final ACK.
+				peer.write("TEXT:last:bye\n")
+				if reply := peer.reply(); reply != "ACK:last:DONE" {
+					t.Fatalf("reply = %q, want ACK:last:DONE", reply)
+				}
+			})
+		}
+	})
+}
+
+func TestFileTransferSlowLink(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.StallTimeout = 200 * time.Millisecond
+	})
+	received := make(chan ReceivedFile, 1)
+	s.opts.OnFileReceived = func(f ReceivedFile) { received <- f }
+	peer := dialTestPeer(t, serveTestChat(t, s))
+
+	// The first part arrives fast, growing the splice chunks, and the rest
+	// trickles in over several stall timeouts.
+	fast := bytes.Repeat([]byte("f"), 8<<20)
+	slow := bytes.Repeat([]byte("s"), 64<<10)
+	const slowParts = 16
+	peer.write(fmt.Sprintf("FILE_START:f1:slow.bin:%d\n", len(fast)+slowParts*len(slow)))
+	peer.write(string(fast))
+	for i := 0; i < slowParts; i++ {
+		time.Sleep(50 * time.Millisecond)
+		peer.write(string(slow))
+	}
+	if reply := peer.reply(); reply != "ACK:f1:DONE" {
+		t.Fatalf("reply = %q, want ACK:f1:DONE", reply)
+	}
+	f := <-received
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(fast) + slowParts*len(slow)); info.Size() != want {
+		t.Errorf("size = %v, want %v", info.Size(), want)
+	}
+}
+
+func TestFileTransferStalled(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.StallTimeout = 200 * time.Millisecond
+	})
+	peer := dialTestPeer(t, serveTestChat(t, s))
+	peer.write("FILE_START:f1:stalled.bin:1048576\n")
+	peer.write(string(bytes.Repeat([]byte("x"), 1000)))
+	if reply := peer.reply(); reply != errorMessage("f1", rejectTransferStalled) {
+		t.Fatalf("reply = %q, want %q", reply, errorMessage("f1", rejectTransferStalled))
+	}
+}
+
+// BenchmarkFileTransfer compares receiving files with splice, over plain
+// TCP, with reading them through the connection buffer, as over TLS or
+// with a byte rate limit.
+func BenchmarkFileTransfer(b *testing.B) {
+	for _, bench := range []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{"splice", nil},
+		{"buffered", func(cfg *Config) {
+			// Never throttles, but takes the buffered path.
+			cfg.Limits.BytesPerSecond = 1 << 40
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := newTestServer(b, func(cfg *Config) {
+				cfg.Limits.MessagesPerSecond = 0
+				if bench.configure != nil {
+					bench.configure(cfg)
+				}
+			})
+			s.opts.OnFileReceived = func(f ReceivedFile) { os.Remove(f.Path) }
+			peer := dialTestPeer(b, serveTestChat(b, s))
+			data := string(bytes.Repeat([]byte("0123456789abcdef"), 1<<20))
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				id := fmt.Sprintf("f%d", i)
+				peer.write(fmt.Sprintf("FILE_START:%s:bench.bin:%d\n", id, len(data)))
+				peer.write(data)
+				if reply := peer.reply(); reply != "ACK:"+id+":DONE" {
+					b.Fatalf("reply = %q", reply)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,549 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"cylonix.io/tailchatd/events"
+)
+
+// Config is the server configuration. tailchatd loads it from its YAML
+// config file.
+type Config struct {
+	Listen    ListenConfig    `yaml:"listen"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Buffer    BufferConfig    `yaml:"buffer"`
+	Quota     QuotaConfig     `yaml:"quota"`
+	ACL       ACLConfig       `yaml:"acl"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Admin     AdminConfig     `yaml:"admin"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Hooks     []HookConfig    `yaml:"hooks"`
+	Outbox    OutboxConfig    `yaml:"outbox"`
+	Push      PushConfig      `yaml:"push"`
+	Receipts  ReceiptsConfig  `yaml:"receipts"`
+	Files     FilesConfig     `yaml:"files"`
+
+	Subscribers SubscribersConfig `yaml:"subscribers"`
+
+	// ShutdownTimeout is how long in-flight transfers may take to finish
+	// on shutdown before they are interrupted and checkpointed.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// ListenConfig holds the listen addresses. Changes require a restart.
+type ListenConfig struct {
+	Chat       string `yaml:"chat"`
+	Subscriber string `yaml:"subscriber"` // Loopback by default. Commands are accepted from loopback only.
+
+	// Events is the subscriber port for JSON events, where subscribers must
+	// send a HELLO first. Loopback by default. Disabled if empty.
+	Events string `yaml:"events"`
+
+	// TailnetOnly binds the chat port to the local tailnet addresses only,
+	// following them as they come and go. The host of Chat must be empty.
+	TailnetOnly bool `yaml:"tailnet_only"`
+}
+
+// StorageConfig holds the storage paths. Changes require a restart.
+type StorageConfig struct {
+	CacheDir   string `yaml:"cache_dir"`
+	BufferFile string `yaml:"buffer_file"` // Relative to CacheDir unless absolute.
+}
+
+// BufferConfig holds the buffering policies of connections and of the
+// messages kept while no subscriber is connected.
+type BufferConfig struct {
+	FileBufferSize int           `yaml:"file_buffer_size"`
+	AckInterval    time.Duration `yaml:"ack_interval"`
+	MaxMessages    int           `yaml:"max_messages"` // 0 is unlimited. Oldest are dropped first.
+}
+
+// QuotaConfig limits what peers can store on this device. Zero is unlimited.
+type QuotaConfig struct {
+	MaxFileSize  int64 `yaml:"max_file_size"`
+	MaxCacheSize int64 `yaml:"max_cache_size"`
+}
+
+// ACLConfig restricts which peers can connect to the chat port. Entries are
+// addresses or CIDR prefixes. Deny takes precedence over allow and an empty
+// allow list allows everyone not denied.
+type ACLConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// LimitsConfig limits the connections and the traffic of the peers. Rates
+// are per peer address, shared by its connections. Zero is unlimited.
+type LimitsConfig struct {
+	MaxConnections      int `yaml:"max_connections"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+
+	// Messages above the rate are rejected with an error reply.
+	MessagesPerSecond float64 `yaml:"messages_per_second"`
+	MessageBurst      int     `yaml:"message_burst"` // Defaults to the rate.
+
+	// Reads are throttled to the byte rate, file data included.
+	BytesPerSecond int64 `yaml:"bytes_per_second"`
+	BytesBurst     int64 `yaml:"bytes_burst"` // Defaults to the rate.
+
+	// Connections sending longer lines are closed. MaxTextSize applies to
+	// the messages with a body, TEXT, CTRL, GROUP_TEXT and GROUP_SYNC, and
+	// MaxLineSize to the other messages.
+	MaxLineSize int `yaml:"max_line_size"`
+	MaxTextSize int `yaml:"max_text_size"`
+
+	// Connections are closed when no message starts within IdleTimeout,
+	// a started message is not complete within HeaderTimeout, or a file
+	// transfer receives nothing for StallTimeout.
+	IdleTimeout   time.Duration `yaml:"idle_timeout"`
+	HeaderTimeout time.Duration `yaml:"header_timeout"`
+	StallTimeout  time.Duration `yaml:"stall_timeout"`
+
+	// Connections are closed when a reply cannot be written within
+	// WriteTimeout. It applies to connections accepted after a change.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+}
+
+func (l *LimitsConfig) messageBurst() int {
+	if l.MessageBurst > 0 {
+		return l.MessageBurst
+	}
+	return int(math.Max(1, math.Ceil(l.MessagesPerSecond)))
+}
+
+func (l *LimitsConfig) bytesBurst() int64 {
+	if l.BytesBurst > 0 {
+		return l.BytesBurst
+	}
+	return l.BytesPerSecond
+}
+
+// DiscoveryConfig holds the peer discovery options.
+type DiscoveryConfig struct {
+	DNSServer  string        `yaml:"dns_server"`
+	DNSTimeout time.Duration `yaml:"dns_timeout"`
+	LAN        LANConfig     `yaml:"lan"`
+}
+
+// LANConfig holds the options of the mDNS discovery of the peers on the
+// LAN, for networks without a tailnet. Changes require a restart.
+type LANConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Interface string `yaml:"interface"` // Defaults to the system multicast interface.
+	Name      string `yaml:"name"`      // Service instance name. Defaults to the hostname.
+}
+
+// MetricsConfig holds the Prometheus metrics endpoint options. Changes
+// require a restart.
+type MetricsConfig struct {
+	Listen string `yaml:"listen"` // Loopback address. Disabled if empty.
+}
+
+// AdminConfig holds the admin API options. Changes require a restart.
+type AdminConfig struct {
+	Socket string `yaml:"socket"` // Unix socket path. Disabled if empty.
+}
+
+// TLSConfig holds the options of the encrypted chat transport for networks
+// without WireGuard. Changes require a restart.
+type TLSConfig struct {
+	// Mode is off, optional or required. Optional accepts TLS and plaintext
+	// peers. Required refuses plaintext except from loopback and tailnet
+	// addresses, which WireGuard already protects.
+	Mode string `yaml:"mode"`
+
+	// Name is the device name in the certificate, by which the peers pin
+	// its key. Defaults to the hostname.
+	Name string `yaml:"name"`
+}
+
+// HookConfig runs an action on the TEXT, CTRL and FILE_END events passed to
+// the subscribers. Exactly one of URL and Command is set.
+type HookConfig struct {
+	Name    string   `yaml:"name"`
+	URL     string   `yaml:"url"`     // Loopback URL the event is POSTed to as JSON.
+	Command []string `yaml:"command"` // Command run with the event as JSON on stdin.
+	Types   []string `yaml:"types"`   // Event types to run on. Empty is all.
+	Peers   []string `yaml:"peers"`   // Peer addresses or CIDR prefixes. Empty is all.
+
+	// Timeout limits each attempt. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries is how many times a failed attempt is retried, with a backoff
+	// doubling from one second.
+	Retries int `yaml:"retries"`
+
+	peers []netip.Prefix
+}
+
+// OutboxConfig holds the delivery policies of the messages queued by the
+// subscribers for the peers.
+type OutboxConfig struct {
+	// MaxMessages limits the queued messages of all peers. 0 is unlimited.
+	MaxMessages int `yaml:"max_messages"`
+
+	// MaxAge is how long a message is retried before it fails. 0 retries
+	// until the message is canceled.
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// Failed deliveries are retried with a backoff doubling from
+	// RetryBackoff up to MaxBackoff, and right away when the peer shows up
+	// in the peer table or connects.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+
+	// Timeout limits connecting, each write and waiting for the ACK.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// SendDir is the directory files may be sent from, symlinks resolved.
+	// FILE messages are refused if it is empty.
+	SendDir string `yaml:"send_dir"`
+}
+
+// PushConfig holds the options of waking suspended peers, such as iOS
+// devices, with a connection request pushed through pnserver when the outbox
+// cannot reach them. Peers are pushed to the device UUID they announced or
+// that was registered for them with the admin API.
+type PushConfig struct {
+	URL string `yaml:"url"` // pnserver endpoint, e.g. https://cylonix.io/apn/tailchat. Disabled if empty.
+
+	// SenderID is the push device UUID of this device, sent as the sender
+	// of the pushes. pnserver refuses pushes without it, so it is required
+	// with URL.
+	SenderID       string `yaml:"sender_id"`
+	Sender         string `yaml:"sender"`          // User name shown in the notification.
+	SenderHostname string `yaml:"sender_hostname"` // Defaults to the hostname.
+	Message        string `yaml:"message"`
+
+	// WakeWindow is how long to wait for a pushed peer to reconnect before
+	// retrying the delivery.
+	WakeWindow time.Duration `yaml:"wake_window"`
+
+	// Timeout limits each request to pnserver.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ReceiptsConfig selects the receipts sent back to the senders of the
+// received messages. They are off by default: the receipts for the peers
+// that do not listen, such as send-only apps, wait in the outbox.
+type ReceiptsConfig struct {
+	Delivered bool `yaml:"delivered"` // Once a subscriber has taken the message.
+	Read      bool `yaml:"read"`      // Once a subscriber reported it as shown.
+}
+
+// SubscribersConfig selects the format of the events passed to the
+// subscribers.
+type SubscribersConfig struct {
+	// Format is given to the subscribers that send no HELLO: legacy or
+	// json.
+	Format string `yaml:"format"`
+	// HelloTimeout is how long a new subscriber of the subscriber port may
+	// take to send its HELLO, delaying its first event. 0 does not wait,
+	// leaving the subscribers the default format; JSON subscribers use the
+	// events port instead.
+	HelloTimeout time.Duration `yaml:"hello_timeout"`
+}
+
+// FilesConfig holds the consent policy and the metadata of the incoming
+// files.
+type FilesConfig struct {
+	// Consent makes the peers offer their files with FILE_OFFER. Offers
+	// not matching an AutoAccept rule are passed to the subscribers, which
+	// accept or reject them within OfferTimeout. Without consent, all files
+	// are accepted.
+	Consent      bool          `yaml:"consent"`
+	OfferTimeout time.Duration `yaml:"offer_timeout"`
+	AutoAccept   []FileRule    `yaml:"auto_accept"`
+
+	// Metadata passes FILE_END to the subscribers with the FileMetadata
+	// of the file instead of its path.
+	Metadata bool `yaml:"metadata"`
+	// ThumbnailSize is the largest side in pixels of the image thumbnails.
+	// 0 disables them.
+	ThumbnailSize int `yaml:"thumbnail_size"`
+}
+
+// FileRule matches the files accepted without asking.
+type FileRule struct {
+	Peers   []string `yaml:"peers"`    // Addresses or CIDR prefixes. Empty is all.
+	MaxSize int64    `yaml:"max_size"` // 0 is any size.
+
+	peers []netip.Prefix
+}
+
+// DefaultConfig returns the config used for settings not in the config file.
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{
+			Chat:       ":50311",
+			Subscriber: "127.0.0.1:50312",
+			Events:     "127.0.0.1:50313",
+		},
+		Storage: StorageConfig{
+			CacheDir:   filepath.Join("/var", "lib", "tailchat", "tailchat"),
+			BufferFile: bufferFile,
+		},
+		Buffer: BufferConfig{
+			FileBufferSize: 1024 * 64,
+			AckInterval:    time.Millisecond * 500,
+		},
+		TLS: TLSConfig{
+			Mode: TLSModeOff,
+		},
+		Limits: LimitsConfig{
+			MaxConnections: 64,
+			MaxLineSize:    1024 * 1024,
+			MaxTextSize:    1024 * 1024,
+			IdleTimeout:    10 * time.Minute,
+			HeaderTimeout:  30 * time.Second,
+			StallTimeout:   time.Minute,
+			WriteTimeout:   30 * time.Second,
+		},
+		Discovery: DiscoveryConfig{
+			DNSTimeout: time.Second,
+		},
+		Outbox: OutboxConfig{
+			MaxMessages:  1000,
+			MaxAge:       7 * 24 * time.Hour,
+			RetryBackoff: 5 * time.Second,
+			MaxBackoff:   5 * time.Minute,
+			Timeout:      30 * time.Second,
+		},
+		Push: PushConfig{
+			Message:    "ping",
+			WakeWindow: 30 * time.Second,
+			Timeout:    10 * time.Second,
+		},
+		Files: FilesConfig{
+			OfferTimeout:  2 * time.Minute,
+			ThumbnailSize: 128,
+		},
+		Subscribers: SubscribersConfig{
+			Format: events.FormatLegacy,
+		},
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// BufferFilePath returns the path of the buffered message file.
+func (c *Config) BufferFilePath() string {
+	if filepath.IsAbs(c.Storage.BufferFile) {
+		return c.Storage.BufferFile
+	}
+	return filepath.Join(c.Storage.CacheDir, c.Storage.BufferFile)
+}
+
+// Validate checks the config and prepares the parsed ACL.
+func (c *Config) Validate() error {
+	var errs []error
+	for name, addr := range map[string]string{
+		"listen.chat":       c.Listen.Chat,
+		"listen.subscriber": c.Listen.Subscriber,
+	} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", name, err))
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.Listen.Events); c.Listen.Events != "" && err != nil {
+		errs = append(errs, fmt.Errorf("listen.events: %w", err))
+	}
+	if host, _, _ := net.SplitHostPort(c.Listen.Chat); c.Listen.TailnetOnly && host != "" {
+		errs = append(errs, fmt.Errorf("listen.chat must not have a host with listen.tailnet_only: %q", c.Listen.Chat))
+	}
+	if !filepath.IsAbs(c.Storage.CacheDir) {
+		errs = append(errs, fmt.Errorf("storage.cache_dir must be an absolute path: %q", c.Storage.CacheDir))
+	}
+	if c.Storage.BufferFile == "" {
+		errs = append(errs, fmt.Errorf("storage.buffer_file must not be empty"))
+	}
+	if c.Buffer.FileBufferSize < 4096 || c.Buffer.FileBufferSize > 16*1024*1024 {
+		errs = append(errs, fmt.Errorf("buffer.file_buffer_size must be between 4KiB and 16MiB: %v", c.Buffer.FileBufferSize))
+	}
+	if c.Buffer.AckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("buffer.ack_interval must be positive: %v", c.Buffer.AckInterval))
+	}
+	if c.Buffer.MaxMessages < 0 {
+		errs = append(errs, fmt.Errorf("buffer.max_messages must not be negative: %v", c.Buffer.MaxMessages))
+	}
+	if c.Quota.MaxFileSize < 0 || c.Quota.MaxCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("quotas must not be negative"))
+	}
+	if c.Limits.MaxConnections < 0 || c.Limits.MaxConnectionsPerIP < 0 || c.Limits.MessagesPerSecond < 0 ||
+		c.Limits.MessageBurst < 0 || c.Limits.BytesPerSecond < 0 || c.Limits.BytesBurst < 0 ||
+		c.Limits.MaxLineSize < 0 || c.Limits.MaxTextSize < 0 ||
+		c.Limits.IdleTimeout < 0 || c.Limits.HeaderTimeout < 0 || c.Limits.StallTimeout < 0 || c.Limits.WriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("limits must not be negative"))
+	}
+	var err error
+	if c.ACL.allow, err = parsePrefixes(c.ACL.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("acl.allow: %w", err))
+	}
+	if c.ACL.deny, err = parsePrefixes(c.ACL.Deny); err != nil {
+		errs = append(errs, fmt.Errorf("acl.deny: %w", err))
+	}
+	if c.Discovery.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(withDNSPort(c.Discovery.DNSServer)); err != nil {
+			errs = append(errs, fmt.Errorf("discovery.dns_server: %w", err))
+		}
+	}
+	if c.Metrics.Listen != "" && !isLoopbackAddr(c.Metrics.Listen) {
+		errs = append(errs, fmt.Errorf("metrics.listen must be a loopback address: %q", c.Metrics.Listen))
+	}
+	if c.Admin.Socket != "" && !filepath.IsAbs(c.Admin.Socket) {
+		errs = append(errs, fmt.Errorf("admin.socket must be an absolute path: %q", c.Admin.Socket))
+	}
+	names := make(map[string]bool)
+	for i := range c.Hooks {
+		hook := &c.Hooks[i]
+		if hook.Timeout == 0 {
+			hook.Timeout = 10 * time.Second
+		}
+		if err := hook.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("hooks[%d]: %w", i, err))
+		}
+		if names[hook.Name] {
+			errs = append(errs, fmt.Errorf("hooks[%d]: duplicate name %q", i, hook.Name))
+		}
+		names[hook.Name] = true
+	}
+	switch c.TLS.Mode {
+	case TLSModeOff, TLSModeOptional, TLSModeRequired:
+	default:
+		errs = append(errs, fmt.Errorf("tls.mode must be off, optional or required: %q", c.TLS.Mode))
+	}
+	if c.Outbox.MaxMessages < 0 || c.Outbox.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("outbox.max_messages and outbox.max_age must not be negative"))
+	}
+	if c.Outbox.RetryBackoff <= 0 || c.Outbox.MaxBackoff < c.Outbox.RetryBackoff {
+		errs = append(errs, fmt.Errorf("outbox.retry_backoff must be positive and at most outbox.max_backoff: %v, %v", c.Outbox.RetryBackoff, c.Outbox.MaxBackoff))
+	}
+	if c.Outbox.SendDir != "" && !filepath.IsAbs(c.Outbox.SendDir) {
+		errs = append(errs, fmt.Errorf("outbox.send_dir must be an absolute path: %q", c.Outbox.SendDir))
+	}
+	if c.Outbox.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("outbox.timeout must be positive: %v", c.Outbox.Timeout))
+	}
+	if c.Push.URL != "" {
+		if err := validatePushURL(c.Push.URL); err != nil {
+			errs = append(errs, fmt.Errorf("push.url: %w", err))
+		}
+	}
+	if c.Push.URL != "" && c.Push.SenderID == "" {
+		errs = append(errs, errors.New("push.sender_id is required with push.url"))
+	}
+	if c.Push.SenderID != "" && !uuidPattern.MatchString(c.Push.SenderID) {
+		errs = append(errs, fmt.Errorf("push.sender_id must be a UUID: %q", c.Push.SenderID))
+	}
+	if c.Push.WakeWindow <= 0 || c.Push.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("push.wake_window and push.timeout must be positive"))
+	}
+	if c.Files.OfferTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("files.offer_timeout must be positive: %v", c.Files.OfferTimeout))
+	}
+	if c.Files.ThumbnailSize < 0 || c.Files.ThumbnailSize > 1024 {
+		errs = append(errs, fmt.Errorf("files.thumbnail_size must be 0 to 1024: %v", c.Files.ThumbnailSize))
+	}
+	if c.Subscribers.Format != events.FormatLegacy && c.Subscribers.Format != events.FormatJSON {
+		errs = append(errs, fmt.Errorf("subscribers.format must be legacy or json: %q", c.Subscribers.Format))
+	}
+	if c.Subscribers.HelloTimeout < 0 {
+		errs = append(errs, fmt.Errorf("subscribers.hello_timeout must not be negative: %v", c.Subscribers.HelloTimeout))
+	}
+	for i := range c.Files.AutoAccept {
+		rule := &c.Files.AutoAccept[i]
+		if rule.peers, err = parsePrefixes(rule.Peers); err != nil {
+			errs = append(errs, fmt.Errorf("files.auto_accept[%d].peers: %w", i, err))
+		}
+		if rule.MaxSize < 0 {
+			errs = append(errs, fmt.Errorf("files.auto_accept[%d].max_size must not be negative", i))
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be positive: %v", c.ShutdownTimeout))
+	}
+	if c.Discovery.DNSTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("discovery.dns_timeout must be positive: %v", c.Discovery.DNSTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Allowed returns if a peer at addr may connect.
+func (a *ACLConfig) Allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range a.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedSections returns which of the sections applied live differ from
+// old.
+func (c *Config) changedSections(old *Config) map[string]bool {
+	return map[string]bool{
+		"buffer":      !reflect.DeepEqual(old.Buffer, c.Buffer),
+		"quota":       !reflect.DeepEqual(old.Quota, c.Quota),
+		"acl":         !reflect.DeepEqual(old.ACL, c.ACL),
+		"limits":      !reflect.DeepEqual(old.Limits, c.Limits),
+		"discovery":   !reflect.DeepEqual(old.Discovery, c.Discovery),
+		"hooks":       !reflect.DeepEqual(old.Hooks, c.Hooks),
+		"outbox":      !reflect.DeepEqual(old.Outbox, c.Outbox),
+		"push":        !reflect.DeepEqual(old.Push, c.Push),
+		"receipts":    !reflect.DeepEqual(old.Receipts, c.Receipts),
+		"files":       !reflect.DeepEqual(old.Files, c.Files),
+		"subscribers": !reflect.DeepEqual(old.Subscribers, c.Subscribers),
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dedupMaxIDsPerPeer limits the message ids remembered for each peer.
+	// The oldest are forgotten first.
+	dedupMaxIDsPerPeer = 1000
+
+	// dedupMaxPeers limits the peers whose message ids are remembered. The
+	// peer that sent nothing for the longest is forgotten first.
+	dedupMaxPeers = 256
+
+	// dedupSaveDelay is how long the new ids are gathered before they are
+	// saved. Ids handled within it before a crash may be passed on again.
+	dedupSaveDelay = 5 * time.Second
+)
+
+// SeenIDs are the ids of the messages recently handled from a peer.
+type SeenIDs struct {
+	IDs     []string  `json:"ids"` // Oldest first.
+	Updated time.Time `json:"updated"`
+}
+
+// dedupSet remembers the ids of the messages handled from each peer, so
+// that the messages retried by a peer after reconnecting are acknowledged
+// without passing them to the subscribers again.
+type dedupSet struct {
+	server *Server
+
+	mutex     sync.Mutex
+	peers     map[string]*SeenIDs // Peer address -> ids.
+	index     map[string]map[string]bool
+	dirty     bool // The ids changed since they were saved.
+	saveTimer *time.Timer
+}
+
+func newDedupSet(s *Server) *dedupSet {
+	return &dedupSet{
+		server: s,
+		peers:  make(map[string]*SeenIDs),
+		index:  make(map[string]map[string]bool),
+	}
+}
+
+// load loads the saved message ids.
+func (d *dedupSet) load() {
+	peers, err := d.server.storage.LoadSeenIDs()
+	if err != nil {
+		d.server.chatLog.Error("Failed to load the seen message ids", "err", d.server.redactPath(err))
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for peer, seen := range peers {
+		d.peers[peer] = seen
+		index := make(map[string]bool, len(seen.IDs))
+		for _, id := range seen.IDs {
+			index[id] = true
+		}
+		d.index[peer] = index
+	}
+}
+
+// deduplicated returns if the type of message is deduplicated by id, and
+// the type.
+func deduplicated(message string) (string, bool) {
+	kind, _, _ := strings.Cut(message, ":")
+	switch kind {
+	case "TEXT", "CTRL", "GROUP_TEXT", "GROUP_SYNC", "RECEIPT", "FILE_START":
+		return kind, true
+	}
+	return kind, false
+}
+
+// seen returns if the message with id was handled from peer.
+func (d *dedupSet) seen(peer netip.Addr, id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.index[peer.String()][id]
+}
+
+// add remembers that the message with id was handled from peer.
+func (d *dedupSet) add(peer netip.Addr, id string) {
+	key := peer.String()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	seen, ok := d.peers[key]
+	if !ok {
+		if len(d.peers) >= dedupMaxPeers {
+			d.forgetOldestPeerLocked()
+		}
+		seen = &SeenIDs{}
+		d.peers[key] = seen
+		d.index[key] = make(map[string]bool)
+	}
+	index := d.index[key]
+	if index[id] {
+		return
+	}
+	index[id] = true
+	seen.IDs = append(seen.IDs, id)
+	if len(seen.IDs) > dedupMaxIDsPerPeer {
+		delete(index, seen.IDs[0])
+		seen.IDs = append(seen.IDs[:0], seen.IDs[1:]...)
+	}
+	seen.Updated = time.Now()
+	d.dirty = true
+	if d.saveTimer == nil {
+		d.saveTimer = time.AfterFunc(dedupSaveDelay, d.flush)
+	}
+}
+
+// flush saves the message ids if they changed. It is called on shutdown.
+func (d *dedupSet) flush() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.saveTimer != nil {
+		d.saveTimer.Stop()
+		d.saveTimer = nil
+	}
+	if !d.dirty {
+		return
+	}
+	d.dirty = false
+	if err := d.server.storage.SaveSeenIDs(d.peers); err != nil {
+		d.server.chatLog.Error("Failed to save the seen message ids", "err", d.server.redactPath(err))
+	}
+}
+
+func (d *dedupSet) forgetOldestPeerLocked() {
+	oldest := ""
+	for peer, seen := range d.peers {
+		if oldest == "" || seen.Updated.Before(d.peers[oldest].Updated) {
+			oldest = peer
+		}
+	}
+	delete(d.peers, oldest)
+	delete(d.index, oldest)
+}
+
+// discardFile is the IncomingFile of a file received again. The data is
+// read and dropped.
+type discardFile struct{}
+
+func (discardFile) Write(p []byte) (int, error)                     { return len(p), nil }
+func (discardFile) Commit() (string, error)                         { return "", nil }
+func (discardFile) Checkpoint(checkpoint *TransferCheckpoint) error { return nil }
+func (discardFile) Abort()                                          {}
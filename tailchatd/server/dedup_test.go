@@ -0,0 +1,50 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDedupSet(t *testing.T) {
+	s := newTestServer(t, nil)
+	peer := netip.MustParseAddr("100.64.0.1")
+	other := netip.MustParseAddr("100.64.0.2")
+
+	s.dedup.add(peer, "m1")
+	if !s.dedup.seen(peer, "m1") {
+		t.Error("resent id m1 was not seen")
+	}
+	if s.dedup.seen(peer, "m2") {
+		t.Error("new id m2 was seen")
+	}
+	if s.dedup.seen(other, "m1") {
+		t.Error("id m1 of another peer was seen")
+	}
+
+	// The ids are saved on flush and seen again after a restart.
+	s.dedup.flush()
+	restarted := newDedupSet(s)
+	restarted.load()
+	if !restarted.seen(peer, "m1") {
+		t.Error("resent id m1 was not seen after a restart")
+	}
+	if restarted.seen(peer, "m2") {
+		t.Error("new id m2 was seen after a restart")
+	}
+}
+
+func TestDedupSetForgetsOldest(t *testing.T) {
+	s := newTestServer(t, nil)
+	peer := netip.MustParseAddr("100.64.0.1")
+	s.dedup.add(peer, "first")
+	for i := 0; i < dedupMaxIDsPerPeer; i++ {
+		s.dedup.add(peer, newMessageID())
+	}
+	if s.dedup.seen(peer, "first") {
+		t.Error("oldest id was not forgotten")
+	}
+	s.dedup.flush()
+}
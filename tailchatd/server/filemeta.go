@@ -0,0 +1,320 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/gif" // Decoders for the dimensions and the thumbnails.
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"cylonix.io/tailchatd/events"
+)
+
+const (
+	// thumbnailMaxPixels limits the images decoded for a thumbnail. A 4K
+	// screenshot fits, as a 32 MiB image once decoded.
+	thumbnailMaxPixels = 8 << 20
+
+	// thumbnailMaxFileSize limits the image files decoded for a thumbnail.
+	thumbnailMaxFileSize = 64 * 1024 * 1024
+
+	// thumbnailSamples is how many source pixels are averaged along each
+	// axis for a pixel of a thumbnail.
+	thumbnailSamples = 4
+
+	thumbnailQuality = 75
+
+	// mp4MaxBoxes limits the boxes walked for the dimensions of a video.
+	mp4MaxBoxes = 10000
+
+	// inspectMaxFiles limits the received files inspected at once.
+	inspectMaxFiles = 2
+)
+
+// FileMetadata describes a received file. It is passed to the subscribers
+// as "FILE_END:<id>:<json FileMetadata>" if files.metadata is set, and to
+// the hooks and OnFileReceived. The thumbnail is made after the ACK to the
+// peer and passed to the subscribers as "FILE_META:<id>:<json
+// FileMetadata>" with the rest of the metadata.
+type FileMetadata struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"` // Where Storage put the file.
+	Name       string    `json:"name"` // Name sent by the peer.
+	Size       int64     `json:"size"`
+	MIME       string    `json:"mime"`             // Sniffed from the data, or by the extension of the name.
+	Peer       string    `json:"peer"`             // Remote address of the peer connection.
+	Sender     string    `json:"sender,omitempty"` // Hostname of the peer in the peer table.
+	Started    time.Time `json:"started"`          // When the peer started sending on this connection.
+	Received   time.Time `json:"received"`
+	DurationMS int64     `json:"duration_ms"`
+	Width      int       `json:"width,omitempty"`     // Images, and MP4 and QuickTime videos.
+	Height     int       `json:"height,omitempty"`    // Images, and MP4 and QuickTime videos.
+	Thumbnail  string    `json:"thumbnail,omitempty"` // JPEG data URL, for PNG, JPEG and GIF images. FILE_META only.
+}
+
+// notifyFile describes the received file of meta, then passes it to the
+// subscribers, the hooks and OnFileReceived as coming from peer. It runs on
+// the connection goroutine before the ACK to the peer. The thumbnail of an
+// image is made afterwards in the background, at most inspectMaxFiles at
+// once, and passed to the subscribers as FILE_META.
+func (s *Server) notifyFile(meta *FileMetadata, peer *events.Peer) error {
+	thumbnailSize := s.Config().Files.ThumbnailSize
+	thumbnail := s.inspectFile(meta, thumbnailSize)
+	e, err := events.New(events.FileEnd, meta.ID, meta)
+	if err != nil {
+		return err
+	}
+	e.Time, e.Peer = meta.Received, peer
+	s.broadcastOrBufferEvent(e)
+	s.hooks.dispatch(&HookEvent{
+		Type: "FILE_END",
+		ID:   meta.ID,
+		Name: meta.Name,
+		Path: meta.Path,
+		Size: meta.Size,
+		Peer: meta.Peer,
+		Time: meta.Received,
+		File: meta,
+	})
+	if s.opts.OnFileReceived != nil {
+		s.opts.OnFileReceived(ReceivedFile{
+			ID:       meta.ID,
+			Name:     meta.Name,
+			Path:     meta.Path,
+			Size:     meta.Size,
+			Peer:     meta.Peer,
+			Metadata: meta,
+		})
+	}
+	if !thumbnail {
+		return nil
+	}
+
+	full := *meta
+	s.inspecting.Add(1)
+	go func() {
+		defer s.inspecting.Done()
+		s.inspections <- struct{}{}
+		defer func() { <-s.inspections }()
+		thumbnail, err := thumbnailFile(full.Path, thumbnailSize)
+		if err != nil {
+			s.transferLog.Debug("Failed to make thumbnail", "id", full.ID, "err", s.redactPath(err))
+			return
+		}
+		full.Thumbnail = thumbnail
+		e, err := events.New(events.FileMeta, full.ID, &full)
+		if err != nil {
+			s.transferLog.Error("Failed to create file event", "id", full.ID, "err", err)
+			return
+		}
+		e.Peer = peer
+		s.broadcastOrBufferEvent(e)
+	}()
+	return nil
+}
+
+// inspectFile fills in the MIME type and the dimensions of the file at
+// meta.Path, and returns if it is an image to make a thumbnail of that fits
+// thumbnailSize. A file Storage did not put on disk is described by its
+// name only.
+func (s *Server) inspectFile(meta *FileMetadata, thumbnailSize int) bool {
+	meta.MIME = fileMIMEType(meta.Name)
+	f, err := os.Open(meta.Path)
+	if err != nil {
+		s.transferLog.Debug("Cannot inspect received file", "id", meta.ID, "err", s.redactPath(err))
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if sniffed := http.DetectContentType(head); !genericMIMEType(sniffed) {
+		meta.MIME = sniffed
+	}
+
+	switch {
+	case strings.HasPrefix(meta.MIME, "image/"):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
+		config, _, err := image.DecodeConfig(f)
+		if err != nil {
+			return false
+		}
+		meta.Width, meta.Height = config.Width, config.Height
+		return thumbnailSize > 0 && meta.Size <= thumbnailMaxFileSize && config.Width*config.Height <= thumbnailMaxPixels
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		meta.Width, meta.Height = mp4Dimensions(f, meta.Size)
+	}
+	return false
+}
+
+// thumbnailFile returns the thumbnail of the image at path.
+func thumbnailFile(path string, size int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return makeThumbnail(f, size)
+}
+
+// genericMIMEType returns if a sniffed MIME type says less than the
+// extension of the name.
+func genericMIMEType(mimeType string) bool {
+	return mimeType == "application/octet-stream" || strings.HasPrefix(mimeType, "text/plain")
+}
+
+// makeThumbnail decodes the image in r and returns it scaled to fit size
+// pixels as a JPEG data URL.
+func makeThumbnail(r io.Reader, size int) (string, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/w)
+			dst.SetRGBA(x, y, averageColor(src, x0, y0, x1, y1))
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// averageColor returns the average of up to thumbnailSamples² pixels of
+// src spread over [x0, x1) × [y0, y1), composited over white.
+func averageColor(src image.Image, x0, y0, x1, y1 int) color.RGBA {
+	var r, g, b, n uint32
+	for i := 0; i < thumbnailSamples; i++ {
+		y := y0 + i*(y1-y0)/thumbnailSamples
+		for j := 0; j < thumbnailSamples; j++ {
+			x := x0 + j*(x1-x0)/thumbnailSamples
+			cr, cg, cb, ca := src.At(x, y).RGBA()
+			white := 0xffff - ca
+			r += (cr + white) >> 8
+			g += (cg + white) >> 8
+			b += (cb + white) >> 8
+			n++
+		}
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 0xff}
+}
+
+// mp4Dimensions returns the dimensions of the first video track of an MP4
+// or QuickTime file of size bytes, from the tkhd box of a trak in the moov
+// box. It returns zeros if there is none.
+func mp4Dimensions(r io.ReaderAt, size int64) (width, height int) {
+	boxes := 0
+	var walk func(start, end int64, path string) bool
+	walk = func(start, end int64, path string) bool {
+		for offset := start; offset+8 <= end; {
+			if boxes++; boxes > mp4MaxBoxes {
+				return true
+			}
+			var header [16]byte
+			if _, err := r.ReadAt(header[:8], offset); err != nil {
+				return true
+			}
+			boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+			kind := string(header[4:8])
+			headerSize := int64(8)
+			switch boxSize {
+			case 0:
+				boxSize = end - offset
+			case 1:
+				if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+					return true
+				}
+				boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+				headerSize = 16
+			}
+			if boxSize < headerSize || boxSize > end-offset {
+				return true
+			}
+			body, bodyEnd := offset+headerSize, offset+boxSize
+			switch {
+			case path == "" && kind == "moov", path == "moov" && kind == "trak":
+				if walk(body, bodyEnd, kind) {
+					return true
+				}
+			case path == "trak" && kind == "tkhd":
+				if w, h := tkhdDimensions(r, body, bodyEnd); w > 0 && h > 0 {
+					width, height = w, h
+					return true
+				}
+			}
+			offset = bodyEnd
+		}
+		return false
+	}
+	walk(0, size, "")
+	return width, height
+}
+
+// tkhdDimensions returns the width and height of a tkhd box with the body
+// at [start, end). Tracks that are not video have zeros.
+func tkhdDimensions(r io.ReaderAt, start, end int64) (width, height int) {
+	var version [1]byte
+	if _, err := r.ReadAt(version[:], start); err != nil {
+		return 0, 0
+	}
+	// The version and flags, the times, the track id and the duration, then
+	// the reserved fields, the layer, the group, the volume and the matrix.
+	offset := start + 4 + 20 + 52
+	if version[0] == 1 {
+		offset += 12
+	}
+	if offset+8 > end {
+		return 0, 0
+	}
+	var dims [8]byte
+	if _, err := r.ReadAt(dims[:], offset); err != nil {
+		return 0, 0
+	}
+	// 16.16 fixed point.
+	return int(binary.BigEndian.Uint32(dims[:4]) >> 16), int(binary.BigEndian.Uint32(dims[4:]) >> 16)
+}
+
+// peerHostname returns the hostname of the peer at addr in the peer table.
+func (s *Server) peerHostname(addr netip.Addr) string {
+	for _, peer := range s.discovery.Peers() {
+		if peerAddr, err := netip.ParseAddr(peer.Address); err == nil && peerAddr.Unmap() == addr {
+			for _, name := range []string{peer.Hostname, peer.FQDN, peer.MachineName} {
+				if name != "" && name != peer.Address {
+					return strings.TrimSuffix(name, ".")
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testPNG returns a PNG image of width by height pixels.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fileMetadata returns the metadata of a FILE_END or FILE_META line.
+func fileMetadata(t *testing.T, line, kind string) FileMetadata {
+	t.Helper()
+	body, ok := strings.CutPrefix(line, kind+":")
+	if !ok {
+		t.Fatalf("line = %q, want %v", line, kind)
+	}
+	_, data, _ := strings.Cut(body, ":")
+	var meta FileMetadata
+	if err := json.Unmarshal([]byte(data), &meta); err != nil {
+		t.Fatalf("invalid %v %q: %v", kind, line, err)
+	}
+	return meta
+}
+
+// subscriberLine returns the next line passed to sub other than the peer
+// table.
+func subscriberLine(sub *testPeer) string {
+	sub.t.Helper()
+	for {
+		if line := sub.reply(); !strings.HasPrefix(line, "NETWORK:") {
+			return line
+		}
+	}
+}
+
+func TestFileEndBeforeThumbnail(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Files.Metadata = true
+	})
+	sub := connectTestSubscriber(t, s)
+	peer := dialTestPeer(t, serveTestChat(t, s))
+
+	// FILE_END is passed before the ACK, and before the later messages of
+	// the peer, with the dimensions. The thumbnail follows in FILE_META.
+	data := testPNG(t, 32, 16)
+	peer.write(fmt.Sprintf("FILE_START:f1:a.png:%d\n%s", len(data), data))
+	if reply := peer.reply(); reply != "ACK:f1:DONE" {
+		t.Fatalf("reply = %q, want ACK:f1:DONE", reply)
+	}
+	peer.write("TEXT:t1:hi\n")
+	if reply := peer.reply(); reply != "ACK:t1:DONE" {
+		t.Fatalf("reply = %q, want ACK:t1:DONE", reply)
+	}
+	meta := fileMetadata(t, subscriberLine(sub), "FILE_END")
+	if meta.MIME != "image/png" || meta.Width != 32 || meta.Height != 16 || meta.Thumbnail != "" {
+		t.Errorf("FILE_END = %+v, want a 32x16 PNG without thumbnail", meta)
+	}
+	var full FileMetadata
+	for text := false; !text || full.ID == ""; {
+		switch line := subscriberLine(sub); {
+		case strings.HasPrefix(line, "FILE_META:"):
+			full = fileMetadata(t, line, "FILE_META")
+		case strings.HasPrefix(line, "TEXT:t1:"):
+			text = true
+		}
+	}
+	if full.ID != "f1" || full.Width != 32 || !strings.HasPrefix(full.Thumbnail, "data:image/jpeg;base64,") {
+		t.Errorf("FILE_META = %+v, want the metadata with a thumbnail", full)
+	}
+}
+
+func TestFileMetaLegacy(t *testing.T) {
+	s := newTestServer(t, nil)
+	sub := connectTestSubscriber(t, s)
+	peer := dialTestPeer(t, serveTestChat(t, s))
+
+	// Legacy subscribers without metadata get the path only.
+	data := testPNG(t, 8, 8)
+	peer.write(fmt.Sprintf("FILE_START:f1:a.png:%d\n%s", len(data), data))
+	if reply := peer.reply(); reply != "ACK:f1:DONE" {
+		t.Fatalf("reply = %q, want ACK:f1:DONE", reply)
+	}
+	if line := subscriberLine(sub); !strings.HasPrefix(line, "FILE_END:f1:/") {
+		t.Fatalf("line = %q, want FILE_END with the path", line)
+	}
+	s.inspecting.Wait()
+	peer.write("TEXT:t1:hi\n")
+	peer.reply()
+	if line := subscriberLine(sub); line != "TEXT:t1:hi" {
+		t.Errorf("line = %q, want TEXT:t1:hi", line)
+	}
+}
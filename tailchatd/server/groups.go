@@ -0,0 +1,452 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group messages between the daemons. A group message is delivered to each
+// member as "GROUP_TEXT:<id>:<group id>:<body>" and passed to the
+// subscribers as is. Membership changes are sent to the old and new members
+// as "GROUP_SYNC:<id>:<json group>" and passed to the subscribers as
+// "GROUP:<group id>:<json group>". Subscribers change a group with
+// "GROUP_SET:<group id>:<json group>".
+const (
+	groupTextPrefix  = "GROUP_TEXT:"
+	groupSyncPrefix  = "GROUP_SYNC:"
+	groupEventPrefix = "GROUP:"
+	groupSetPrefix   = "GROUP_SET:"
+)
+
+// Rejection reasons of group messages.
+const (
+	rejectUnknownGroup  = "unknown_group"
+	rejectNotMember     = "not_a_member"
+	rejectInvalidGroup  = "invalid_group"
+	rejectTooManyGroups = "too_many_groups"
+)
+
+// Limits of the group store. The groups this device left are dropped once
+// not updated for groupsExpiry.
+const (
+	groupsMaxGroups  = 256
+	groupsMaxMembers = 256
+	groupsExpiry     = 30 * 24 * time.Hour
+)
+
+// rejectedError rejects a message with an error reply to the peer, keeping
+// the connection.
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string { return "rejected: " + e.reason }
+
+// Group is a group conversation. The members are the hostnames or
+// addresses of the peers, this device included, with an optional port.
+type Group struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Members   []string  `json:"members"`
+	Version   int64     `json:"version"` // Incremented by each change.
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// validate checks g and normalizes its members.
+func (g *Group) validate() error {
+	if g.ID == "" || strings.ContainsAny(g.ID, ":\n ") {
+		return fmt.Errorf("invalid group id %q", g.ID)
+	}
+	if strings.Contains(g.Name, "\n") {
+		return errors.New("name must be a single line")
+	}
+	if len(g.Members) > groupsMaxMembers {
+		return fmt.Errorf("more than %d members", groupsMaxMembers)
+	}
+	seen := make(map[string]bool)
+	members := g.Members[:0:0]
+	for _, member := range g.Members {
+		member = normalizeMember(member)
+		if member == "" || strings.ContainsAny(member, "\n ") {
+			return fmt.Errorf("invalid member %q", member)
+		}
+		if !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	g.Members = members
+	return nil
+}
+
+// newer returns if g supersedes old, the group with the higher version
+// winning and the updater breaking ties.
+func (g *Group) newer(old *Group) bool {
+	if g.Version != old.Version {
+		return g.Version > old.Version
+	}
+	return g.UpdatedBy > old.UpdatedBy
+}
+
+// groupStore keeps the groups this device is or was a member of.
+type groupStore struct {
+	server *Server
+
+	mutex  sync.Mutex
+	groups map[string]*Group
+}
+
+func newGroupStore(s *Server) *groupStore {
+	return &groupStore{server: s, groups: make(map[string]*Group)}
+}
+
+// load loads the saved groups.
+func (g *groupStore) load() {
+	groups, err := g.server.storage.LoadGroups()
+	if err != nil {
+		g.server.chatLog.Error("Failed to load the groups", "err", g.server.redactPath(err))
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i := range groups {
+		g.groups[groups[i].ID] = &groups[i]
+	}
+	if g.expireLocked(time.Now()) {
+		g.saveLocked()
+	}
+}
+
+// expireLocked drops the groups this device is not a member of that were
+// not updated since groupsExpiry before now. It returns if any were.
+func (g *groupStore) expireLocked(now time.Time) bool {
+	changed := false
+	for id, group := range g.groups {
+		if now.Sub(group.Updated) > groupsExpiry && !g.isSelfMember(group) {
+			g.server.chatLog.Info("Group expired", "group", id)
+			delete(g.groups, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// isSelfMember returns if this device is one of the members of group.
+func (g *groupStore) isSelfMember(group *Group) bool {
+	for _, member := range group.Members {
+		if g.server.isSelf(member) {
+			return true
+		}
+	}
+	return false
+}
+
+// fullLocked returns if no new group can be added, after dropping the
+// expired ones.
+func (g *groupStore) fullLocked() bool {
+	if len(g.groups) < groupsMaxGroups {
+		return false
+	}
+	g.expireLocked(time.Now())
+	return len(g.groups) >= groupsMaxGroups
+}
+
+func (g *groupStore) saveLocked() {
+	groups := make([]Group, 0, len(g.groups))
+	for _, group := range g.groups {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	if err := g.server.storage.SaveGroups(groups); err != nil {
+		g.server.chatLog.Error("Failed to save the groups", "err", g.server.redactPath(err))
+	}
+}
+
+// list returns the groups by id.
+func (g *groupStore) list() []Group {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	groups := make([]Group, 0, len(g.groups))
+	for _, group := range g.groups {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups
+}
+
+// get returns the group with id.
+func (g *groupStore) get(id string) (Group, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	group, ok := g.groups[id]
+	if !ok {
+		return Group{}, false
+	}
+	return *group, true
+}
+
+// set creates or changes a group on this device and syncs it to its old and
+// new members.
+func (g *groupStore) set(update Group) (Group, error) {
+	if err := update.validate(); err != nil {
+		return update, err
+	}
+	if len(update.Members) == 0 {
+		return update, errors.New("members must not be empty")
+	}
+	hostname, _ := os.Hostname()
+
+	g.mutex.Lock()
+	old := g.groups[update.ID]
+	var notify []string
+	if old != nil {
+		update.Version = old.Version + 1
+		notify = append(notify, old.Members...)
+	} else {
+		if g.fullLocked() {
+			g.mutex.Unlock()
+			return update, fmt.Errorf("more than %d groups", groupsMaxGroups)
+		}
+		update.Version = 1
+	}
+	update.UpdatedBy = hostname
+	update.Updated = time.Now()
+	group := update
+	g.groups[update.ID] = &group
+	g.saveLocked()
+	g.mutex.Unlock()
+
+	g.server.chatLog.Info("Group updated", "group", update.ID, "version", update.Version, "members", len(update.Members))
+	g.broadcast(update)
+	g.sync(update, append(notify, update.Members...))
+	return update, nil
+}
+
+// sync sends group to the peers that are not this device.
+func (g *groupStore) sync(group Group, peers []string) {
+	data, err := json.Marshal(group)
+	if err != nil {
+		g.server.chatLog.Error("Failed to marshal group", "group", group.ID, "err", err)
+		return
+	}
+	var messages []OutboundMessage
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		if seen[peer] || g.server.isSelf(peer) {
+			continue
+		}
+		seen[peer] = true
+		messages = append(messages, OutboundMessage{
+			ID:   newMessageID(),
+			Peer: normalizePeer(peer),
+			Type: "GROUP_SYNC",
+			Body: string(data),
+		})
+	}
+	if len(messages) == 0 {
+		return
+	}
+	if _, err := g.server.outbox.add(messages); err != nil {
+		g.server.chatLog.Error("Failed to queue group sync", "group", group.ID, "err", err)
+	}
+}
+
+// broadcast passes group to the subscribers.
+func (g *groupStore) broadcast(group Group) {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return
+	}
+	g.server.broadcastOrBufferMessage(groupEventPrefix + group.ID + ":" + string(data))
+}
+
+// fanOut returns the outbox addresses of the members of the group with id
+// other than this device.
+func (g *groupStore) fanOut(id string) ([]string, error) {
+	group, ok := g.get(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown group %q", id)
+	}
+	var peers []string
+	isMember := false
+	for _, member := range group.Members {
+		if g.server.isSelf(member) {
+			isMember = true
+			continue
+		}
+		peers = append(peers, normalizePeer(member))
+	}
+	if !isMember {
+		return nil, fmt.Errorf("not a member of group %q", id)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("group %q has no other members", id)
+	}
+	return peers, nil
+}
+
+// receiveSync applies a group update from the peer at remote. The peer
+// must be a member before or, for a new group, after the update. New groups
+// this device is not a member of are ignored.
+func (g *groupStore) receiveSync(remote netip.Addr, body string) error {
+	var update Group
+	if err := json.Unmarshal([]byte(body), &update); err != nil {
+		return &rejectedError{rejectInvalidGroup}
+	}
+	if err := update.validate(); err != nil {
+		return &rejectedError{rejectInvalidGroup}
+	}
+
+	g.mutex.Lock()
+	old := g.groups[update.ID]
+	members := update.Members
+	if old != nil {
+		members = old.Members
+	}
+	if !g.server.isMember(members, remote) {
+		g.mutex.Unlock()
+		return &rejectedError{rejectNotMember}
+	}
+	if old != nil && !update.newer(old) {
+		g.mutex.Unlock()
+		g.server.chatLog.Debug("Ignoring stale group update", "group", update.ID, "version", update.Version, "have", old.Version)
+		return nil
+	}
+	if old == nil {
+		if !g.isSelfMember(&update) {
+			g.mutex.Unlock()
+			g.server.chatLog.Debug("Ignoring group without this device", "group", update.ID, "remote", remote.String())
+			return nil
+		}
+		if g.fullLocked() {
+			g.mutex.Unlock()
+			return &rejectedError{rejectTooManyGroups}
+		}
+	}
+	// The expiry counts from the local time of the update.
+	if now := time.Now(); update.Updated.After(now) {
+		update.Updated = now
+	}
+	group := update
+	g.groups[update.ID] = &group
+	g.saveLocked()
+	g.mutex.Unlock()
+
+	g.server.chatLog.Info("Group synced", "group", update.ID, "version", update.Version, "members", len(update.Members), "remote", remote.String())
+	g.broadcast(update)
+	return nil
+}
+
+// checkSender checks that the peer at remote is a member of the group with
+// id.
+func (g *groupStore) checkSender(id string, remote netip.Addr) error {
+	group, ok := g.get(id)
+	if !ok {
+		return &rejectedError{rejectUnknownGroup}
+	}
+	if !g.server.isMember(group.Members, remote) {
+		return &rejectedError{rejectNotMember}
+	}
+	return nil
+}
+
+// isMember returns if the peer at addr is one of members, by address or by
+// its names in the peer table.
+func (s *Server) isMember(members []string, addr netip.Addr) bool {
+	names := map[string]bool{addr.String(): true}
+	for _, peer := range s.discovery.Peers() {
+		if peerAddr, err := netip.ParseAddr(peer.Address); err == nil && peerAddr.Unmap() == addr {
+			for _, name := range []string{peer.Hostname, peer.FQDN, peer.MachineName} {
+				if name != "" {
+					names[normalizePeerName(name)] = true
+				}
+			}
+		}
+	}
+	for _, member := range members {
+		if names[memberHost(member)] {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelf returns if member is this device, by a local address, the
+// hostname or the names of the local entries of the peer table, and by the
+// chat port if the member has one.
+func (s *Server) isSelf(member string) bool {
+	if _, port, err := net.SplitHostPort(member); err == nil {
+		_, chatPort, _ := net.SplitHostPort(s.Config().Listen.Chat)
+		if port != chatPort {
+			return false
+		}
+	}
+	host := memberHost(member)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if prefix, err := netip.ParsePrefix(a.String()); err == nil && prefix.Addr().Unmap() == addr {
+				return true
+			}
+		}
+		return false
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hostname = normalizePeerName(hostname)
+		if host == hostname || strings.HasPrefix(host, hostname+".") {
+			return true
+		}
+	}
+	for _, peer := range s.discovery.Peers() {
+		if !peer.IsLocal {
+			continue
+		}
+		for _, name := range []string{peer.Hostname, peer.FQDN, peer.MachineName} {
+			if name != "" && normalizePeerName(name) == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeMember returns member with the host normalized like the peer
+// names.
+func normalizeMember(member string) string {
+	if host, port, err := net.SplitHostPort(member); err == nil {
+		return net.JoinHostPort(normalizePeerName(host), port)
+	}
+	return normalizePeerName(member)
+}
+
+// memberHost returns the host of a member without the port.
+func memberHost(member string) string {
+	if host, _, err := net.SplitHostPort(member); err == nil {
+		return normalizePeerName(host)
+	}
+	return normalizePeerName(member)
+}
+
+// newMessageID returns a random UUID like the message ids of the app.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
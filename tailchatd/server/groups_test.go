@@ -0,0 +1,78 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGroupSyncLimits(t *testing.T) {
+	s := newTestServer(t, nil)
+	t.Cleanup(s.outbox.stop)
+	g := s.groups
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip("no hostname")
+	}
+	remote := netip.MustParseAddr("100.64.0.5")
+	sync := func(group Group) error {
+		data, err := json.Marshal(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.receiveSync(remote, string(data))
+	}
+	rejected := func(err error, reason string) bool {
+		var rejected *rejectedError
+		return errors.As(err, &rejected) && rejected.reason == reason
+	}
+
+	// New groups without this device are not kept.
+	if err := sync(Group{ID: "other", Members: []string{"100.64.0.5", "100.64.0.6"}, Version: 1}); err != nil {
+		t.Errorf("sync without this device: %v", err)
+	}
+	if _, ok := g.get("other"); ok {
+		t.Error("group without this device kept")
+	}
+
+	members := []string{hostname, "100.64.0.5"}
+	for i := 0; i < groupsMaxMembers; i++ {
+		members = append(members, fmt.Sprintf("peer%d", i))
+	}
+	if err := sync(Group{ID: "big", Members: members, Version: 1}); !rejected(err, rejectInvalidGroup) {
+		t.Errorf("sync of %d members: %v, want %v", len(members), err, rejectInvalidGroup)
+	}
+
+	g.mutex.Lock()
+	for i := 0; i < groupsMaxGroups; i++ {
+		id := fmt.Sprint(i)
+		g.groups[id] = &Group{ID: id, Members: []string{hostname}, Version: 1, Updated: time.Now()}
+	}
+	g.mutex.Unlock()
+	group := Group{ID: "new", Members: []string{hostname, "100.64.0.5"}, Version: 1}
+	if err := sync(group); !rejected(err, rejectTooManyGroups) {
+		t.Errorf("sync over the limit: %v, want %v", err, rejectTooManyGroups)
+	}
+
+	// Groups this device left expire, making room for the new ones.
+	g.mutex.Lock()
+	g.groups["0"].Members = []string{"100.64.0.6"}
+	g.groups["0"].Updated = time.Now().Add(-groupsExpiry - time.Hour)
+	g.mutex.Unlock()
+	if err := sync(group); err != nil {
+		t.Errorf("sync after the expiry: %v", err)
+	}
+	if _, ok := g.get("0"); ok {
+		t.Error("expired group kept")
+	}
+	if _, ok := g.get("new"); !ok {
+		t.Error("new group not kept")
+	}
+}
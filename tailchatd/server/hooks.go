@@ -0,0 +1,286 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hookQueueSize      = 256
+	hookWorkers        = 4
+	hookRetryBackoff   = time.Second
+	hookMaxOutputBytes = 1024
+)
+
+// HookEvent is passed to the hooks as JSON, in the body of the POST request
+// or on the stdin of the command.
+type HookEvent struct {
+	Type string    `json:"type"` // TEXT, CTRL or FILE_END.
+	ID   string    `json:"id"`
+	Body string    `json:"body,omitempty"` // TEXT and CTRL only.
+	Name string    `json:"name,omitempty"` // FILE_END only.
+	Path string    `json:"path,omitempty"` // FILE_END only.
+	Size int64     `json:"size,omitempty"` // FILE_END only.
+	Peer string    `json:"peer"`           // Remote address of the peer connection.
+	Time time.Time `json:"time"`
+
+	Group string        `json:"group,omitempty"` // Group conversation of a TEXT message.
+	File  *FileMetadata `json:"file,omitempty"`  // FILE_END only.
+}
+
+// hookJob is one event to deliver to one hook.
+type hookJob struct {
+	hook  HookConfig
+	event *HookEvent
+	data  []byte
+}
+
+// hookRunner delivers the events to the hooks on a few worker goroutines so
+// that the peer connections are never blocked by a slow hook. Events are
+// dropped if the queue is full.
+type hookRunner struct {
+	server *Server
+	queue  chan hookJob
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *http.Client
+	wg     sync.WaitGroup
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+func newHookRunner(s *Server) *hookRunner {
+	h := &hookRunner{
+		server: s,
+		queue:  make(chan hookJob, hookQueueSize),
+		client: &http.Client{},
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	return h
+}
+
+func (h *hookRunner) start() {
+	for i := 0; i < hookWorkers; i++ {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for job := range h.queue {
+				h.run(job)
+			}
+		}()
+	}
+}
+
+// dispatch queues event for each of the configured hooks that match it.
+func (h *hookRunner) dispatch(event *HookEvent) {
+	hooks := h.server.Config().Hooks
+	if len(hooks) == 0 {
+		return
+	}
+	var data []byte
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.matches(event) {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(event); err != nil {
+				h.server.hookLog.Error("Failed to marshal hook event", "id", event.ID, "err", err)
+				return
+			}
+		}
+		select {
+		case h.queue <- hookJob{hook: hook, event: event, data: data}:
+		default:
+			h.server.hookLog.Warn("Hook queue full. Dropping event", "hook", hook.Name, "type", event.Type, "id", event.ID)
+			h.server.metrics.hookRuns.Inc(hook.Name, "dropped")
+		}
+	}
+}
+
+// stop stops queueing events and waits until ctx is done for the queued
+// ones to be delivered. Deliveries still running then are canceled.
+func (h *hookRunner) stop(ctx context.Context) {
+	h.mutex.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		h.server.hookLog.Warn("Hooks still running. Canceling", "queued", len(h.queue))
+		h.cancel()
+		<-done
+	}
+	h.cancel()
+}
+
+// run delivers the job, retrying with a backoff on failure.
+func (h *hookRunner) run(job hookJob) {
+	log := h.server.hookLog.With("hook", job.hook.Name, "type", job.event.Type, "id", job.event.ID)
+	backoff := hookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if h.ctx.Err() != nil {
+			h.server.metrics.hookRuns.Inc(job.hook.Name, "canceled")
+			return
+		}
+		start := time.Now()
+		err := h.deliver(&job)
+		if err == nil {
+			log.Debug("Hook done", "attempt", attempt+1, "ms", time.Since(start).Milliseconds())
+			h.server.metrics.hookRuns.Inc(job.hook.Name, "ok")
+			return
+		}
+		if attempt >= job.hook.Retries {
+			log.Error("Hook failed", "attempts", attempt+1, "err", err)
+			h.server.metrics.hookRuns.Inc(job.hook.Name, "error")
+			return
+		}
+		log.Warn("Hook failed. Retrying", "attempt", attempt+1, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-h.ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+func (h *hookRunner) deliver(job *hookJob) error {
+	ctx, cancel := context.WithTimeout(h.ctx, job.hook.Timeout)
+	defer cancel()
+	if job.hook.URL != "" {
+		return h.post(ctx, job)
+	}
+	return h.exec(ctx, job)
+}
+
+func (h *hookRunner) post(ctx context.Context, job *hookJob) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.hook.URL, bytes.NewReader(job.data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tailchatd")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, hookMaxOutputBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+func (h *hookRunner) exec(ctx context.Context, job *hookJob) error {
+	cmd := exec.CommandContext(ctx, job.hook.Command[0], job.hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(job.data)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > hookMaxOutputBytes {
+			output = output[:hookMaxOutputBytes]
+		}
+		return fmt.Errorf("%w: %v", err, h.server.sensitive(strings.TrimSpace(string(output))).LogValue())
+	}
+	return nil
+}
+
+// matches returns if the hook runs on event.
+func (c *HookConfig) matches(event *HookEvent) bool {
+	if len(c.Types) > 0 {
+		found := false
+		for _, t := range c.Types {
+			if t == event.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(c.peers) == 0 {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(event.Peer)
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range c.peers {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the hook and prepares the parsed peers.
+func (c *HookConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	if (c.URL == "") == (len(c.Command) == 0) {
+		return fmt.Errorf("exactly one of url or command must be set")
+	}
+	if c.URL != "" {
+		req, err := http.NewRequest(http.MethodPost, c.URL, nil)
+		if err != nil {
+			return fmt.Errorf("url: %w", err)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("url must be http or https: %q", c.URL)
+		}
+		port := req.URL.Port()
+		if port == "" {
+			port = "80"
+		}
+		if !isLoopbackAddr(net.JoinHostPort(req.URL.Hostname(), port)) {
+			return fmt.Errorf("url must be on a loopback address: %q", c.URL)
+		}
+	}
+	for _, t := range c.Types {
+		if t != "TEXT" && t != "CTRL" && t != "FILE_END" {
+			return fmt.Errorf("types must be TEXT, CTRL or FILE_END: %q", t)
+		}
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive: %v", c.Timeout)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative: %v", c.Retries)
+	}
+	var err error
+	if c.peers, err = parsePrefixes(c.Peers); err != nil {
+		return fmt.Errorf("peers: %w", err)
+	}
+	return nil
+}
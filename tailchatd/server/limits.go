@@ -0,0 +1,230 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// errorPrefix starts the error replies to peers, as "ERROR:<id>:<reason>".
+// The id is that of the rejected message, or "daemon" if the connection is
+// rejected as a whole.
+const errorPrefix = "ERROR:"
+
+// Rejection reasons, sent to the peer and counted in the metrics.
+const (
+	rejectMaxConnections      = "too_many_connections"
+	rejectMaxConnectionsPerIP = "too_many_connections_from_address"
+	rejectMessageRate         = "rate_limited"
+	rejectMessageTooLarge     = "message_too_large"
+	rejectIdleTimeout         = "idle_timeout"
+	rejectHeaderTimeout       = "header_timeout"
+	rejectTransferStalled     = "transfer_stalled"
+)
+
+var errTransferStalled = errors.New("transfer stalled")
+
+// errorMessage returns the error reply to a peer.
+func errorMessage(id, reason string) string {
+	return errorPrefix + id + ":" + reason
+}
+
+// tokenBucket is a token bucket filled at rate tokens per second up to
+// burst. It is not safe for concurrent use.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) fill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// allow takes n tokens if available.
+func (b *tokenBucket) allow(now time.Time, n, rate, burst float64) bool {
+	b.fill(now, rate, burst)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long to
+// wait until the debt is repaid.
+func (b *tokenBucket) reserve(now time.Time, n, rate, burst float64) time.Duration {
+	b.fill(now, rate, burst)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// peerLimiter holds the rate limits shared by the connections from one peer
+// address.
+type peerLimiter struct {
+	server   *Server
+	addr     netip.Addr
+	conns    int // Guarded by Server.limiterMutex.
+	mutex    sync.Mutex
+	messages tokenBucket
+	bytes    tokenBucket
+}
+
+// admit checks the connection limits for conn. It returns the limiter of
+// the peer, to be released when the connection closes, or the reason the
+// connection is rejected.
+func (s *Server) admit(conn net.Conn) (*peerLimiter, string) {
+	limits := &s.Config().Limits
+	addr := remoteAddr(conn)
+	s.limiterMutex.Lock()
+	defer s.limiterMutex.Unlock()
+	if limits.MaxConnections > 0 && s.admitted >= limits.MaxConnections {
+		return nil, rejectMaxConnections
+	}
+	limiter := s.peerLimiters[addr]
+	if limiter == nil {
+		limiter = &peerLimiter{server: s, addr: addr}
+		s.peerLimiters[addr] = limiter
+	}
+	if limits.MaxConnectionsPerIP > 0 && limiter.conns >= limits.MaxConnectionsPerIP {
+		return nil, rejectMaxConnectionsPerIP
+	}
+	limiter.conns++
+	s.admitted++
+	return limiter, ""
+}
+
+// release ends a connection admitted with the limiter. The limiter is
+// dropped with the last connection of the peer.
+func (s *Server) release(limiter *peerLimiter) {
+	s.limiterMutex.Lock()
+	defer s.limiterMutex.Unlock()
+	s.admitted--
+	limiter.conns--
+	if limiter.conns <= 0 {
+		delete(s.peerLimiters, limiter.addr)
+	}
+}
+
+// rejectConnection sends the reason to the peer and closes conn.
+func (s *Server) rejectConnection(conn net.Conn, reason string) {
+	defer conn.Close()
+	s.chatLog.Warn("Connection rejected", "remote", conn.RemoteAddr().String(), "reason", reason)
+	s.metrics.admissionRejections.Inc(reason)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(errorMessage("daemon", reason) + "\n"))
+}
+
+// allowMessage takes a token for a message from the peer.
+func (l *peerLimiter) allowMessage() bool {
+	limits := &l.server.Config().Limits
+	if limits.MessagesPerSecond <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.messages.allow(time.Now(), 1, limits.MessagesPerSecond, float64(limits.messageBurst()))
+}
+
+// waitBytes takes n tokens for bytes read from the peer, waiting until they
+// are available or ctx is done.
+func (l *peerLimiter) waitBytes(ctx context.Context, n int) {
+	limits := &l.server.Config().Limits
+	if limits.BytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	wait := l.bytes.reserve(time.Now(), float64(n), float64(limits.BytesPerSecond), float64(limits.bytesBurst()))
+	l.mutex.Unlock()
+	if wait <= 0 {
+		return
+	}
+	l.server.metrics.throttledSeconds.Add(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// limitedReader throttles the reads from a peer connection to the byte rate
+// limit of the peer.
+type limitedReader struct {
+	r       io.Reader
+	limiter *peerLimiter
+	ctx     context.Context
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.limiter.waitBytes(r.ctx, n)
+	return n, err
+}
+
+// bodyPrefixes start the message lines carrying a body, which are limited
+// by MaxTextSize rather than MaxLineSize.
+var bodyPrefixes = [][]byte{
+	[]byte("TEXT:"),
+	[]byte("CTRL:"),
+	[]byte(groupTextPrefix),
+	[]byte(groupSyncPrefix),
+}
+
+// lineTooLong returns if a message line, complete or not, is over the size
+// limit of its type.
+func (l *LimitsConfig) lineTooLong(line []byte) bool {
+	max := l.MaxLineSize
+	for _, prefix := range bodyPrefixes {
+		if bytes.HasPrefix(line, prefix) {
+			max = l.MaxTextSize
+			break
+		}
+	}
+	return max > 0 && len(line) > max
+}
+
+// remoteAddr returns the address of the peer of conn.
+func remoteAddr(conn net.Conn) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// acceptBackoff delays accepting after errors such as running out of file
+// descriptors, doubling from 5ms up to a second.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+func (b *acceptBackoff) wait() time.Duration {
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else if b.delay *= 2; b.delay > time.Second {
+		b.delay = time.Second
+	}
+	time.Sleep(b.delay)
+	return b.delay
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
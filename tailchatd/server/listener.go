@@ -0,0 +1,107 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// serveChat accepts peer connections on listener until it is closed.
+func (s *Server) serveChat(listener net.Listener) {
+	s.chatLog.Info("Starting server", "addr", listener.Addr().String())
+	var backoff acceptBackoff
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.chatLog.Info("Stopped listening", "addr", listener.Addr().String())
+			return
+		}
+		if err != nil {
+			s.metrics.connectionErrors.Inc("accept")
+			s.chatLog.Error("Error accepting connection", "err", err, "backoff", backoff.wait())
+			continue
+		}
+		backoff.reset()
+		if acl := &s.Config().ACL; !acl.Allowed(conn.RemoteAddr()) {
+			s.chatLog.Warn("Connection denied by ACL", "remote", conn.RemoteAddr().String())
+			s.metrics.connectionErrors.Inc("acl_denied")
+			conn.Close()
+			continue
+		}
+		limiter, reason := s.admit(conn)
+		if limiter == nil {
+			go s.rejectConnection(conn, reason)
+			continue
+		}
+		go func() {
+			defer s.release(limiter)
+			s.handleConnection(conn, limiter)
+		}()
+	}
+}
+
+// tailnetListeners keeps one chat listener on each local tailnet address so
+// that the chat port is not exposed on other interfaces.
+type tailnetListeners struct {
+	server    *Server
+	port      string
+	listeners map[string]net.Listener
+	mutex     sync.Mutex
+	closed    bool
+}
+
+func (s *Server) newTailnetListeners(port string) *tailnetListeners {
+	return &tailnetListeners{
+		server:    s,
+		port:      port,
+		listeners: make(map[string]net.Listener),
+	}
+}
+
+// update opens listeners on new tailnet addresses and closes the listeners
+// of addresses that went away.
+func (t *tailnetListeners) update(addrs []net.IP) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, ip := range addrs {
+		addr := net.JoinHostPort(ip.String(), t.port)
+		current[addr] = true
+		if _, ok := t.listeners[addr]; ok {
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.server.chatLog.Error("Failed to listen on tailnet address", "addr", addr, "err", err)
+			continue
+		}
+		t.listeners[addr] = listener
+		go t.server.serveChat(listener)
+	}
+	for addr, listener := range t.listeners {
+		if current[addr] {
+			continue
+		}
+		t.server.chatLog.Info("Tailnet address gone. Closing listener", "addr", addr)
+		listener.Close()
+		delete(t.listeners, addr)
+	}
+}
+
+func (t *tailnetListeners) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	for addr, listener := range t.listeners {
+		listener.Close()
+		delete(t.listeners, addr)
+	}
+	return nil
+}
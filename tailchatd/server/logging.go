@@ -0,0 +1,93 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"cylonix.io/tailchatd/events"
+)
+
+// Logging components. Each component logs with its name in the "component"
+// attribute so that handlers can filter them.
+const (
+	ComponentDaemon     = "daemon"
+	ComponentChat       = "chat"
+	ComponentTransfer   = "transfer"
+	ComponentSubscriber = "subscriber"
+	ComponentNetwork    = "network"
+	ComponentHook       = "hook"
+	ComponentOutbox     = "outbox"
+)
+
+// sensitiveValue is a log value that is redacted unless payload debugging
+// is on. Use it for message bodies, file names and hostnames.
+type sensitiveValue struct {
+	value string
+	show  *atomic.Bool
+}
+
+func (s sensitiveValue) LogValue() slog.Value {
+	if s.show.Load() || s.value == "" {
+		return slog.StringValue(s.value)
+	}
+	return slog.StringValue(fmt.Sprintf("[redacted %d bytes]", len(s.value)))
+}
+
+func (s *Server) sensitive(value string) sensitiveValue {
+	return sensitiveValue{value: value, show: &s.debugPayloads}
+}
+
+// messageAttr logs a wire message as its type and id with the rest redacted.
+func (s *Server) messageAttr(message string) slog.Attr {
+	parts := strings.SplitN(message, ":", 3)
+	if parts[0] == "NETWORK" {
+		parts = strings.SplitN(message, ":", 2)
+		return slog.Group("message", slog.String("type", parts[0]), slog.Any("body", s.sensitive(parts[len(parts)-1])))
+	}
+	attrs := []any{slog.String("type", parts[0])}
+	if len(parts) > 1 {
+		attrs = append(attrs, slog.String("id", parts[1]))
+	}
+	if len(parts) > 2 {
+		attrs = append(attrs, slog.Any("body", s.sensitive(parts[2])))
+	}
+	return slog.Group("message", attrs...)
+}
+
+// eventAttr returns e as a log attribute, with the payload only if payload
+// debugging is on.
+func (s *Server) eventAttr(e *events.Event) slog.Attr {
+	attrs := []any{slog.String("type", e.Type)}
+	if e.ID != "" {
+		attrs = append(attrs, slog.String("id", e.ID))
+	}
+	if len(e.Payload) > 0 {
+		attrs = append(attrs, slog.Any("body", s.sensitive(string(e.Payload))))
+	}
+	return slog.Group("message", attrs...)
+}
+
+// redactPath strips the file path from file system errors unless payload
+// debugging is on.
+func (s *Server) redactPath(err error) error {
+	if s.debugPayloads.Load() {
+		return err
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return fmt.Errorf("%v: %w", pathErr.Op, pathErr.Err)
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return fmt.Errorf("%v: %w", linkErr.Op, linkErr.Err)
+	}
+	return err
+}
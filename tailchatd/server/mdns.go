@@ -0,0 +1,519 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+// Peer discovery sources reported in NetworkInfo. Tailnet peers have none.
+const sourceLAN = "lan"
+
+const (
+	mdnsService  = "_tailchat._tcp.local."
+	mdnsTTL      = 120 // Seconds.
+	mdnsInterval = time.Minute
+
+	// mdnsMaxPeers caps the peer table, and mdnsMaxTTL the lifetime of the
+	// records, so that the devices on the LAN cannot grow the table without
+	// limit.
+	mdnsMaxPeers = 256
+	mdnsMaxTTL   = 10 * time.Minute
+
+	// mdnsCacheFlush marks the records that only this device answers for.
+	mdnsCacheFlush = 1 << 15
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// lanPeer is a peer advertising the tailchat service on the LAN.
+type lanPeer struct {
+	instance string
+	host     string
+	port     uint16
+	addr     string // Source address of its announcement.
+	expires  time.Time
+}
+
+// mdnsDiscovery advertises the chat port over multicast DNS as a
+// _tailchat._tcp service and browses for the other devices advertising it.
+// It only uses IPv4.
+type mdnsDiscovery struct {
+	server   *Server
+	iface    *net.Interface // Nil for the system default.
+	instance string
+	host     string
+	port     uint16
+
+	conn     *net.UDPConn
+	onPeers  func([]NetworkInfo)
+	peers    map[string]*lanPeer
+	mutex    sync.Mutex
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newMDNSDiscovery(s *Server) (*mdnsDiscovery, error) {
+	cfg := s.Config()
+	m := &mdnsDiscovery{
+		server: s,
+		peers:  make(map[string]*lanPeer),
+		done:   make(chan struct{}),
+	}
+	if name := cfg.Discovery.LAN.Interface; name != "" {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("discovery.lan.interface: %w", err)
+		}
+		m.iface = iface
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.Discovery.LAN.Name
+	if name == "" {
+		name = hostname
+	}
+	m.instance = mdnsLabel(name) + "." + mdnsService
+	m.host = mdnsLabel(hostname) + ".local."
+	_, port, _ := net.SplitHostPort(cfg.Listen.Chat)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat port %q: %w", port, err)
+	}
+	m.port = uint16(p)
+	return m, nil
+}
+
+// mdnsLabel makes name usable as a single DNS label.
+func mdnsLabel(name string) string {
+	name = strings.ReplaceAll(name, ".", "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+func (m *mdnsDiscovery) Start(onPeers func([]NetworkInfo), _ func([]net.IP)) error {
+	conn, err := net.ListenMulticastUDP("udp4", m.iface, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("failed to join the mDNS group: %w", err)
+	}
+	if err := m.setSocketOptions(conn); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to set up the mDNS socket: %w", err)
+	}
+	m.conn = conn
+	m.onPeers = onPeers
+
+	m.server.networkLog.Info("Starting LAN discovery", "service", mdnsService, "name", m.server.sensitive(m.instance), "port", m.port)
+	go m.receive()
+	go m.run()
+	return nil
+}
+
+// setSocketOptions sends the multicast messages on the interface, with the
+// loopback on so that other instances on this host, or a test on the
+// loopback interface, see them.
+func (m *mdnsDiscovery) setSocketOptions(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		if m.iface != nil {
+			mreq := &unix.IPMreqn{Ifindex: int32(m.iface.Index)}
+			if optErr = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, mreq); optErr != nil {
+				return
+			}
+		}
+		if optErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_LOOP, 1); optErr != nil {
+			return
+		}
+		optErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, 255)
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
+
+// run announces this device and browses for peers, again at each interval
+// to refresh the records before they expire.
+func (m *mdnsDiscovery) run() {
+	m.announce(mdnsTTL)
+	m.query()
+	ticker := time.NewTicker(mdnsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.expire()
+			m.announce(mdnsTTL)
+			m.query()
+		}
+	}
+}
+
+func (m *mdnsDiscovery) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+		if m.conn != nil {
+			// Tell the peers to forget this device right away.
+			m.announce(0)
+			m.conn.Close()
+		}
+	})
+}
+
+// Rescan asks the peers to announce themselves. The answers arrive in the
+// background.
+func (m *mdnsDiscovery) Rescan() {
+	m.expire()
+	m.query()
+}
+
+func (m *mdnsDiscovery) Peers() []NetworkInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var infos []NetworkInfo
+	for _, peer := range m.peers {
+		if peer.port == 0 || peer.addr == "" {
+			continue // Not complete yet.
+		}
+		infos = append(infos, NetworkInfo{
+			Address:     peer.addr,
+			Port:        int(peer.port),
+			Hostname:    strings.TrimSuffix(strings.TrimSuffix(peer.instance, mdnsService), "."),
+			FQDN:        peer.host,
+			MachineName: strings.TrimSuffix(peer.host, ".local."),
+			LookupState: lookupStateResolved,
+			Source:      sourceLAN,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Hostname < infos[j].Hostname })
+	return infos
+}
+
+func (m *mdnsDiscovery) send(msg []byte) {
+	if _, err := m.conn.WriteToUDP(msg, mdnsGroup); err != nil && !errors.Is(err, net.ErrClosed) {
+		m.server.networkLog.Warn("Failed to send mDNS message", "err", err)
+	}
+}
+
+func (m *mdnsDiscovery) query() {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(mdnsService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		m.server.networkLog.Error("Failed to build mDNS query", "err", err)
+		return
+	}
+	m.send(msg)
+}
+
+// announce sends the records of this device with ttl. A ttl of 0 withdraws
+// them.
+func (m *mdnsDiscovery) announce(ttl uint32) {
+	msg, err := m.response(ttl)
+	if err != nil {
+		m.server.networkLog.Error("Failed to build mDNS response", "err", err)
+		return
+	}
+	m.send(msg)
+}
+
+func (m *mdnsDiscovery) response(ttl uint32) ([]byte, error) {
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(m.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(m.host)
+	if err != nil {
+		return nil, err
+	}
+	header := func(name dnsmessage.Name, t dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: t, Class: class, TTL: ttl}
+	}
+	unique := dnsmessage.ClassINET | mdnsCacheFlush
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if err := b.PTRResource(header(service, dnsmessage.TypePTR, dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	if err := b.SRVResource(header(instance, dnsmessage.TypeSRV, unique), dnsmessage.SRVResource{Port: m.port, Target: host}); err != nil {
+		return nil, err
+	}
+	txt := []string{"v=1", "tls=" + m.server.Config().TLS.Mode}
+	if err := b.TXTResource(header(instance, dnsmessage.TypeTXT, unique), dnsmessage.TXTResource{TXT: txt}); err != nil {
+		return nil, err
+	}
+	for _, ip := range m.localAddrs() {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		if err := b.AResource(header(host, dnsmessage.TypeA, unique), a); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// localAddrs returns the IPv4 addresses of the interface, or of all the up
+// interfaces but loopback if none is configured.
+func (m *mdnsDiscovery) localAddrs() []net.IP {
+	ifaces := []net.Interface{}
+	if m.iface != nil {
+		ifaces = append(ifaces, *m.iface)
+	} else if all, err := net.Interfaces(); err == nil {
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// receive answers the queries for the service and records the peers from
+// the responses until the connection is closed.
+func (m *mdnsDiscovery) receive() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := m.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			m.server.networkLog.Warn("Failed to read mDNS message", "err", err)
+			continue
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil {
+			m.server.networkLog.Debug("Invalid mDNS message", "src", src.String(), "err", err)
+			continue
+		}
+		if !header.Response {
+			m.handleQuery(&p)
+			continue
+		}
+		if err := p.SkipAllQuestions(); err != nil {
+			continue
+		}
+		answers, err := p.AllAnswers()
+		if err != nil {
+			continue
+		}
+		additionals, _ := p.AllAdditionals()
+		if m.handleResponse(append(answers, additionals...), src.IP) {
+			m.notify()
+		}
+	}
+}
+
+func (m *mdnsDiscovery) handleQuery(p *dnsmessage.Parser) {
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	for _, q := range questions {
+		if strings.EqualFold(q.Name.String(), mdnsService) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) {
+			m.announce(mdnsTTL)
+			return
+		}
+	}
+}
+
+// handleResponse records the peers in the resource records received from
+// src. It returns if the peer table changed.
+func (m *mdnsDiscovery) handleResponse(records []dnsmessage.Resource, src net.IP) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	changed := false
+	now := time.Now()
+	// The SRV records need the peers from the PTR records.
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Header.Type == dnsmessage.TypePTR && records[j].Header.Type != dnsmessage.TypePTR
+	})
+	for _, r := range records {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name != mdnsService {
+				continue
+			}
+			instance := strings.ToLower(body.PTR.String())
+			if instance == strings.ToLower(m.instance) {
+				continue // This device.
+			}
+			if r.Header.TTL == 0 {
+				if _, ok := m.peers[instance]; ok {
+					m.server.networkLog.Info("LAN peer gone", "name", m.server.sensitive(instance))
+					delete(m.peers, instance)
+					changed = true
+				}
+				continue
+			}
+			peer, ok := m.peers[instance]
+			if !ok {
+				if len(m.peers) >= mdnsMaxPeers && m.expireLocked(now) {
+					changed = true
+				}
+				if len(m.peers) >= mdnsMaxPeers {
+					m.server.networkLog.Debug("LAN peer table full", "name", m.server.sensitive(instance))
+					continue
+				}
+				peer = &lanPeer{instance: instance}
+				m.peers[instance] = peer
+			}
+			peer.expires = now.Add(min(time.Duration(r.Header.TTL)*time.Second, mdnsMaxTTL))
+			if peer.addr != src.String() {
+				peer.addr = src.String()
+				changed = peer.port != 0 || changed
+			}
+		case *dnsmessage.SRVResource:
+			peer, ok := m.peers[name]
+			if !ok || r.Header.TTL == 0 {
+				continue
+			}
+			if peer.port == 0 {
+				m.server.networkLog.Info("LAN peer found", "name", m.server.sensitive(name), "addr", src.String(), "port", body.Port)
+				changed = true
+			}
+			if peer.port != body.Port || peer.host != body.Target.String() {
+				peer.port = body.Port
+				peer.host = body.Target.String()
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// expire drops the peers whose records were not refreshed in time.
+func (m *mdnsDiscovery) expire() {
+	m.mutex.Lock()
+	changed := m.expireLocked(time.Now())
+	m.mutex.Unlock()
+	if changed {
+		m.notify()
+	}
+}
+
+// expireLocked drops the peers expired at now. It returns if any were.
+func (m *mdnsDiscovery) expireLocked(now time.Time) bool {
+	changed := false
+	for instance, peer := range m.peers {
+		if now.After(peer.expires) {
+			m.server.networkLog.Info("LAN peer expired", "name", m.server.sensitive(instance))
+			delete(m.peers, instance)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (m *mdnsDiscovery) notify() {
+	if m.onPeers != nil {
+		m.onPeers(m.Peers())
+	}
+}
+
+// mergedDiscovery reports the peers of several discoveries as one table.
+type mergedDiscovery struct {
+	discoveries []Discovery
+	onPeers     func([]NetworkInfo)
+	mutex       sync.Mutex
+}
+
+func newMergedDiscovery(discoveries ...Discovery) *mergedDiscovery {
+	return &mergedDiscovery{discoveries: discoveries}
+}
+
+func (d *mergedDiscovery) Start(onPeers func([]NetworkInfo), onTailnetAddrs func([]net.IP)) error {
+	d.onPeers = onPeers
+	for i, discovery := range d.discoveries {
+		var addrs func([]net.IP)
+		if i == 0 {
+			addrs = onTailnetAddrs
+		}
+		if err := discovery.Start(d.update, addrs); err != nil {
+			for _, started := range d.discoveries[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// update reports the merged table whenever any of the discoveries changes.
+func (d *mergedDiscovery) update([]NetworkInfo) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.onPeers != nil {
+		d.onPeers(d.Peers())
+	}
+}
+
+func (d *mergedDiscovery) Peers() []NetworkInfo {
+	var infos []NetworkInfo
+	for _, discovery := range d.discoveries {
+		infos = append(infos, discovery.Peers()...)
+	}
+	return infos
+}
+
+func (d *mergedDiscovery) Rescan() {
+	for _, discovery := range d.discoveries {
+		discovery.Rescan()
+	}
+}
+
+func (d *mergedDiscovery) Stop() {
+	for _, discovery := range d.discoveries {
+		discovery.Stop()
+	}
+}
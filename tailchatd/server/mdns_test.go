@@ -0,0 +1,160 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestMDNS returns an mDNS discovery advertising the chat port as name.
+func newTestMDNS(t *testing.T, name, iface, port string) *mdnsDiscovery {
+	t.Helper()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Listen.Chat = ":" + port
+		cfg.Discovery.LAN.Name = name
+		cfg.Discovery.LAN.Interface = iface
+	})
+	m, err := newMDNSDiscovery(s)
+	if err != nil {
+		t.Fatalf("newMDNSDiscovery: %v", err)
+	}
+	return m
+}
+
+// mdnsRecords returns the resource records of an mDNS response.
+func mdnsRecords(t *testing.T, msg []byte) []dnsmessage.Resource {
+	t.Helper()
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return answers
+}
+
+func TestMDNSResponse(t *testing.T) {
+	alpha := newTestMDNS(t, "alpha", "", "50311")
+	beta := newTestMDNS(t, "beta", "", "50411")
+	src := net.IPv4(192, 168, 1, 10)
+
+	msg, err := alpha.response(mdnsTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpha.handleResponse(mdnsRecords(t, msg), src) {
+		t.Error("own announcement added a peer")
+	}
+	if !beta.handleResponse(mdnsRecords(t, msg), src) {
+		t.Fatal("announcement did not change the peer table")
+	}
+	peers := beta.Peers()
+	if len(peers) != 1 {
+		t.Fatalf("peers = %+v, want alpha", peers)
+	}
+	peer := peers[0]
+	if peer.Hostname != "alpha" || peer.Address != src.String() || peer.Port != 50311 || peer.Source != sourceLAN {
+		t.Errorf("peer = %+v, want alpha at %v:50311 from the LAN", peer, src)
+	}
+	if beta.handleResponse(mdnsRecords(t, msg), src) {
+		t.Error("repeated announcement changed the peer table")
+	}
+
+	// A TTL of 0 withdraws the peer.
+	msg, err = alpha.response(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !beta.handleResponse(mdnsRecords(t, msg), src) || len(beta.Peers()) != 0 {
+		t.Errorf("peers = %+v after the withdrawal, want none", beta.Peers())
+	}
+}
+
+func TestMDNSLoopback(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil || lo.Flags&net.FlagMulticast == 0 {
+		t.Skip("no multicast on the loopback interface: ip link set lo multicast on")
+	}
+	alpha := newTestMDNS(t, "alpha", "lo", "50311")
+	beta := newTestMDNS(t, "beta", "lo", "50411")
+
+	found := make(chan []NetworkInfo, 16)
+	onPeers := func(peers []NetworkInfo) {
+		select {
+		case found <- peers:
+		default:
+		}
+	}
+	if err := alpha.Start(func([]NetworkInfo) {}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer alpha.Stop()
+	if err := beta.Start(onPeers, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer beta.Stop()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case peers := <-found:
+			for _, peer := range peers {
+				if peer.Hostname == "alpha" && peer.Port == 50311 {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("alpha not found, peers = %+v", beta.Peers())
+		}
+	}
+}
+
+func TestMDNSPeerLimits(t *testing.T) {
+	m := newTestMDNS(t, "beta", "", "50411")
+	src := net.IPv4(192, 168, 1, 10)
+	service := dnsmessage.MustNewName(mdnsService)
+	announce := func(name string, ttl uint32) bool {
+		instance := dnsmessage.MustNewName(name + "." + mdnsService)
+		return m.handleResponse([]dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.PTRResource{PTR: instance},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(name + ".local."), Port: 50311},
+			},
+		}, src)
+	}
+
+	// The TTL is clamped.
+	announce("peer0", 1<<31)
+	if expires := m.peers["peer0."+mdnsService].expires; time.Until(expires) > mdnsMaxTTL {
+		t.Errorf("peer expires in %v, want at most %v", time.Until(expires), mdnsMaxTTL)
+	}
+
+	// New peers are ignored once the table is full.
+	for i := 1; i < mdnsMaxPeers+10; i++ {
+		announce(fmt.Sprintf("peer%d", i), mdnsTTL)
+	}
+	if len(m.peers) != mdnsMaxPeers {
+		t.Fatalf("%d peers, want %d", len(m.peers), mdnsMaxPeers)
+	}
+
+	// Until the expired peers are dropped.
+	m.peers["peer0."+mdnsService].expires = time.Now().Add(-time.Second)
+	if !announce("late", mdnsTTL) || m.peers["late."+mdnsService] == nil || m.peers["peer0."+mdnsService] != nil {
+		t.Error("expired peer not replaced by a new one")
+	}
+}
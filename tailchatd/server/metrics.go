@@ -0,0 +1,309 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are exported on /metrics in the Prometheus text format.
+type metrics struct {
+	registry []metric
+
+	peerConnections   *gauge
+	messagesReceived  *counter
+	connectionErrors  *counter
+	transferBytes     *counter
+	transfers         *counter
+	transferDuration  *histogram
+	networkRescans    *counter
+	dnsLookupDuration *histogram
+	dnsLookupFailures *counter
+	hookRuns          *counter
+	outboundMessages  *counter
+	outboundRetries   *counter
+	pushRequests      *counter
+	messagesRejected  *counter
+	duplicateMessages *counter
+	fileOffers        *counter
+
+	admissionRejections *counter
+	throttledSeconds    *counter
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{}
+	m.peerConnections = register(m, newGauge("tailchatd_peer_connections",
+		"Active peer connections."))
+	m.messagesReceived = register(m, newCounter("tailchatd_messages_received_total",
+		"Messages received from peers by type.", "type"))
+	m.connectionErrors = register(m, newCounter("tailchatd_connection_errors_total",
+		"Peer connection errors by reason.", "reason"))
+	m.admissionRejections = register(m, newCounter("tailchatd_admission_rejections_total",
+		"Peer connections and messages rejected by the limits, by reason.", "reason"))
+	m.throttledSeconds = register(m, newCounter("tailchatd_throttled_seconds_total",
+		"Time peer reads were delayed by the byte rate limit."))
+	m.transferBytes = register(m, newCounter("tailchatd_transfer_bytes_total",
+		"File bytes received from peers."))
+	m.transfers = register(m, newCounter("tailchatd_transfers_total",
+		"File transfers by result.", "result"))
+	m.transferDuration = register(m, newHistogram("tailchatd_transfer_duration_seconds",
+		"Duration of completed file transfers.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}))
+	m.networkRescans = register(m, newCounter("tailchatd_network_rescans_total",
+		"Network monitor rescans of the tailnet peers."))
+	m.dnsLookupDuration = register(m, newHistogram("tailchatd_dns_lookup_duration_seconds",
+		"Duration of peer hostname lookups including retries.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5}))
+	m.dnsLookupFailures = register(m, newCounter("tailchatd_dns_lookup_failures_total",
+		"Failed peer hostname lookups."))
+	m.hookRuns = register(m, newCounter("tailchatd_hook_runs_total",
+		"Hook deliveries by hook and result.", "hook", "result"))
+	m.outboundMessages = register(m, newCounter("tailchatd_outbound_messages_total",
+		"Outbox messages finished by status.", "status"))
+	m.outboundRetries = register(m, newCounter("tailchatd_outbound_retries_total",
+		"Outbox deliveries that failed and were retried."))
+	m.pushRequests = register(m, newCounter("tailchatd_push_requests_total",
+		"Push requests to pnserver to wake peers, by result.", "result"))
+	m.messagesRejected = register(m, newCounter("tailchatd_messages_rejected_total",
+		"Peer messages rejected with an error reply, by reason.", "reason"))
+	m.duplicateMessages = register(m, newCounter("tailchatd_duplicate_messages_total",
+		"Peer messages received again and acknowledged without handling them, by type.", "type"))
+	m.fileOffers = register(m, newCounter("tailchatd_file_offers_total",
+		"File offers from peers by result.", "result"))
+	register(m, newGaugeFunc("tailchatd_outbox_messages",
+		"Messages queued in the outbox.", func() float64 {
+			return float64(s.outbox.len())
+		}))
+	register(m, newGaugeFunc("tailchatd_subscribers",
+		"Connected subscribers.", func() float64 {
+			s.subscriberMutex.RLock()
+			defer s.subscriberMutex.RUnlock()
+			return float64(len(s.subscribers))
+		}))
+	register(m, newGaugeFunc("tailchatd_buffered_messages",
+		"Messages buffered while no subscriber is connected.", func() float64 {
+			count, _ := s.bufferStats()
+			return float64(count)
+		}))
+	register(m, newGaugeFunc("tailchatd_buffered_bytes",
+		"Size of the buffered messages.", func() float64 {
+			_, size := s.bufferStats()
+			return float64(size)
+		}))
+	return m
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register[M metric](m *metrics, metric M) M {
+	m.registry = append(m.registry, metric)
+	return metric
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a monotonically increasing value, optionally split by labels.
+type counter struct {
+	mutex      sync.Mutex
+	name, help string
+	labels     []string
+	values     map[string]float64 // Keyed by the label values joined by '\x00'.
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counter) Add(v float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[strings.Join(labelValues, "\x00")] += v
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(key, "\x00")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, values), formatValue(c.values[key]))
+	}
+}
+
+// gauge is a value that can go up and down.
+type gauge struct {
+	mutex      sync.Mutex
+	name, help string
+	value      float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) Add(v float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value += v
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value))
+}
+
+// gaugeFunc is a gauge whose value is read when scraped.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	mutex      sync.Mutex
+	name, help string
+	buckets    []float64
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(nil, nil, "le", formatValue(bound)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(nil, nil, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range m.registry {
+		metric.write(w)
+	}
+}
+
+// MetricsHandler returns the handler of the Prometheus metrics, for
+// embedders that serve them on their own server.
+func (s *Server) MetricsHandler() http.Handler {
+	return s.metrics
+}
+
+// serveMetrics serves the metrics endpoint on a loopback address.
+func (s *Server) serveMetrics(addr string) (io.Closer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		s.daemonLog.Info("Starting metrics server", "addr", listener.Addr().String())
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.daemonLog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+	return server, nil
+}
+
+// isLoopbackAddr returns if the host of addr is a loopback address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,533 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Hostname lookup states reported for each peer in NetworkInfo.
+const (
+	lookupStatePending  = "pending"
+	lookupStateFailed   = "failed"
+	lookupStateResolved = "resolved"
+)
+
+const (
+	lookupRetryAttempts   = 5
+	lookupRetryBackoff    = 5 * time.Second
+	lookupRetryMaxBackoff = time.Minute
+)
+
+type NetworkInfo struct {
+	Address       string `json:"address,omitempty"`
+	Hostname      string `json:"hostname"` // The address until the name is resolved.
+	FQDN          string `json:"fqdn,omitempty"`
+	MachineName   string `json:"machine_name,omitempty"`
+	TailnetDomain string `json:"tailnet_domain,omitempty"`
+	IsLocal       bool   `json:"is_local,omitempty"`
+	LookupState   string `json:"lookup_state,omitempty"`
+	Port          int    `json:"port,omitempty"`   // Chat port if discovered on the LAN.
+	Source        string `json:"source,omitempty"` // "lan" for LAN peers, empty for tailnet peers.
+}
+
+type hostnameLookupResult struct {
+	address string
+	name    peerName
+	isLocal bool
+}
+
+// NetworkMonitor is the default Discovery. It finds the peers from the
+// routes of the local tailnet interface and watches the interfaces, addresses
+// and routes with netlink for changes.
+type NetworkMonitor struct {
+	server        *Server
+	linkUpdates   chan netlink.LinkUpdate
+	addrUpdates   chan netlink.AddrUpdate
+	routeUpdates  chan netlink.RouteUpdate
+	done          chan struct{}
+	infos         []NetworkInfo
+	mutex         sync.RWMutex
+	onUpdate      func([]NetworkInfo)
+	onTailnetAddr func([]net.IP)
+	currentCancel context.CancelFunc
+	retryCancel   context.CancelFunc
+	cancelMutex   sync.Mutex
+	stopOnce      sync.Once
+
+	// scans wakes the scan worker. It holds one pending scan, so that the
+	// changes arriving during a scan are coalesced into the next one.
+	scans     chan struct{}
+	scanMutex sync.Mutex // Serializes the scans.
+}
+
+func newNetworkMonitor(s *Server) *NetworkMonitor {
+	return &NetworkMonitor{
+		server:       s,
+		linkUpdates:  make(chan netlink.LinkUpdate),
+		addrUpdates:  make(chan netlink.AddrUpdate),
+		routeUpdates: make(chan netlink.RouteUpdate),
+		done:         make(chan struct{}),
+		scans:        make(chan struct{}, 1),
+	}
+}
+
+func (nm *NetworkMonitor) subscribe() error {
+	if err := netlink.LinkSubscribe(nm.linkUpdates, nm.done); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %w", err)
+	}
+	if err := netlink.AddrSubscribe(nm.addrUpdates, nm.done); err != nil {
+		return fmt.Errorf("failed to subscribe to address updates: %w", err)
+	}
+
+	// Subscribe to all routing tables
+	options := netlink.RouteSubscribeOptions{
+		ErrorCallback: func(err error) {
+			nm.server.networkLog.Error("Route subscription error", "err", err)
+		},
+		ListExisting: true,
+	}
+	if err := netlink.RouteSubscribeWithOptions(nm.routeUpdates, nm.done, options); err != nil {
+		return fmt.Errorf("failed to subscribe to route updates: %w", err)
+	}
+	return nil
+}
+
+func (nm *NetworkMonitor) findCGNATAddresses() ([]NetworkInfo, error) {
+	// Cancel previous lookup if any
+	nm.cancelMutex.Lock()
+	if nm.currentCancel != nil {
+		nm.currentCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	nm.currentCancel = cancel
+	nm.cancelMutex.Unlock()
+
+	// Find CGNAT interface
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	var (
+		infos      []NetworkInfo
+		wg         sync.WaitGroup
+		localAddr  string
+		cgnatIface netlink.Link
+		resultChan = make(chan hostnameLookupResult)
+	)
+	for _, link := range links {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			nm.server.networkLog.Warn("Failed to get interface address list", "interface", link.Attrs().Name, "err", err)
+			continue
+		}
+		for _, addr := range addrs {
+			nm.server.networkLog.Debug("Checking address", "addr", addr.IP.String())
+			if isCGNATAddress(addr.IP.String()) {
+				localAddr = addr.IP.String()
+				cgnatIface = link
+				break
+			}
+		}
+		if cgnatIface != nil {
+			break
+		}
+	}
+	if localAddr == "" || cgnatIface == nil {
+		nm.server.networkLog.Info("No CGNAT interface found. VPN is off?")
+		return nil, nil
+	}
+	cfg := nm.server.Config().Discovery
+	resolver := newHostnameResolver(cfg.DNSServer, true, cfg.DNSTimeout)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			return
+		case resultChan <- hostnameLookupResult{
+			address: localAddr,
+			name:    nm.getHostnameWithContext(ctx, resolver, localAddr),
+			isLocal: true,
+		}:
+		}
+	}()
+
+	// Get routes from all tables associated with CGNAT interface
+	filter := &netlink.Route{
+		Table:     unix.RT_TABLE_UNSPEC,
+		LinkIndex: cgnatIface.Attrs().Index,
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return infos, err
+	}
+
+	seen := make(map[string]bool)
+	seen[localAddr] = true
+
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+		if _, bits := route.Dst.Mask.Size(); bits != 32 {
+			continue
+		}
+		addr := route.Dst.IP.String()
+		if seen[addr] || !isCGNATAddress(addr) {
+			continue
+		}
+		seen[addr] = true
+
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				return
+			case resultChan <- hostnameLookupResult{
+				address: address,
+				name:    nm.getHostnameWithContext(ctx, resolver, address),
+				isLocal: false,
+			}:
+			}
+		}(addr)
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	// Collect results with timeout and cancellation
+	for {
+		select {
+		case <-ctx.Done():
+			return infos, ctx.Err()
+		case result, ok := <-resultChan:
+			if !ok {
+				return infos, nil
+			}
+			info := NetworkInfo{
+				Address:     result.address,
+				Hostname:    result.address,
+				IsLocal:     result.isLocal,
+				LookupState: lookupStatePending,
+			}
+			if result.name.FQDN != "" {
+				info.setName(result.name)
+			}
+			infos = append(infos, info)
+		}
+	}
+}
+
+func (info *NetworkInfo) setName(name peerName) {
+	info.Hostname = name.Hostname()
+	info.FQDN = name.FQDN
+	info.MachineName = name.MachineName
+	info.TailnetDomain = name.TailnetDomain
+	info.LookupState = lookupStateResolved
+}
+
+func (nm *NetworkMonitor) getHostnameWithContext(ctx context.Context, resolver *hostnameResolver, addr string) peerName {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	name, err := getHostnameWithRetry(ctx, resolver, addr)
+	nm.server.metrics.dnsLookupDuration.ObserveSince(start)
+	if err != nil {
+		nm.server.metrics.dnsLookupFailures.Inc()
+		nm.server.networkLog.Warn("Failed to get hostname", "addr", addr, "err", err)
+		return peerName{}
+	}
+	nm.server.networkLog.Debug("Found hostname", "addr", addr, "hostname", nm.server.sensitive(name.Hostname()))
+	return name
+}
+
+// updateNetworkInfo scans the peers and publishes them. Scans run one at a
+// time, so an older scan never overwrites the peers of a newer one.
+func (nm *NetworkMonitor) updateNetworkInfo() {
+	nm.scanMutex.Lock()
+	defer nm.scanMutex.Unlock()
+	nm.server.metrics.networkRescans.Inc()
+	infos, err := nm.findCGNATAddresses()
+	if err != nil {
+		nm.server.networkLog.Error("Error finding CGNAT addresses", "err", err)
+		return
+	}
+
+	nm.mutex.Lock()
+	nm.infos = infos
+	nm.mutex.Unlock()
+
+	if nm.onUpdate != nil {
+		nm.onUpdate(infos)
+	}
+
+	var pending []string
+	for _, info := range infos {
+		if info.LookupState == lookupStatePending {
+			pending = append(pending, info.Address)
+		}
+	}
+	nm.retryLookups(pending)
+}
+
+// retryLookups keeps resolving the hostnames of the pending addresses in the
+// background, replacing the retries of any previous scan. Each peer that
+// resolves is reported with an update. Peers still unresolved after the last
+// attempt are reported as failed.
+func (nm *NetworkMonitor) retryLookups(pending []string) {
+	nm.cancelMutex.Lock()
+	if nm.retryCancel != nil {
+		nm.retryCancel()
+		nm.retryCancel = nil
+	}
+	if len(pending) == 0 {
+		nm.cancelMutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	nm.retryCancel = cancel
+	nm.cancelMutex.Unlock()
+
+	go func() {
+		defer cancel()
+		cfg := nm.server.Config().Discovery
+		resolver := newHostnameResolver(cfg.DNSServer, true, cfg.DNSTimeout)
+		backoff := lookupRetryBackoff
+		for attempt := 1; attempt <= lookupRetryAttempts && len(pending) > 0; attempt++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-nm.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, lookupRetryMaxBackoff)
+
+			var remaining []string
+			for _, addr := range pending {
+				name := nm.getHostnameWithContext(ctx, resolver, addr)
+				if ctx.Err() != nil {
+					return
+				}
+				if name.FQDN == "" {
+					remaining = append(remaining, addr)
+					continue
+				}
+				nm.server.networkLog.Info("Resolved pending peer", "addr", addr, "attempt", attempt)
+				nm.updateLookup(addr, func(info *NetworkInfo) { info.setName(name) })
+			}
+			pending = remaining
+		}
+		for _, addr := range pending {
+			nm.server.networkLog.Warn("Giving up hostname lookup", "addr", addr)
+			nm.updateLookup(addr, func(info *NetworkInfo) { info.LookupState = lookupStateFailed })
+		}
+	}()
+}
+
+// updateLookup applies update to the info of addr and notifies the listener.
+// The info slice is copied so that slices handed out earlier stay unchanged.
+func (nm *NetworkMonitor) updateLookup(addr string, update func(*NetworkInfo)) {
+	nm.mutex.Lock()
+	infos := make([]NetworkInfo, len(nm.infos))
+	copy(infos, nm.infos)
+	found := false
+	for i := range infos {
+		if infos[i].Address == addr {
+			update(&infos[i])
+			found = true
+		}
+	}
+	if found {
+		nm.infos = infos
+	}
+	nm.mutex.Unlock()
+
+	if found && nm.onUpdate != nil {
+		nm.onUpdate(infos)
+	}
+}
+
+func isCGNATAddress(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	return ip[0] == 100 && (ip[1]&0xC0) == 64
+}
+
+// requestScan asks the scan worker for a scan, unless one is pending
+// already.
+func (nm *NetworkMonitor) requestScan() {
+	select {
+	case nm.scans <- struct{}{}:
+	default:
+	}
+}
+
+// scanWorker runs the requested scans one after the other, so that a slow
+// hostname lookup does not hold up the network updates.
+func (nm *NetworkMonitor) scanWorker() {
+	for {
+		select {
+		case <-nm.scans:
+			nm.updateNetworkInfo()
+		case <-nm.done:
+			return
+		}
+	}
+}
+
+// watchNetworkChanges requests a scan on network changes.
+func (nm *NetworkMonitor) watchNetworkChanges() {
+	for {
+		select {
+		case update := <-nm.linkUpdates:
+			nm.server.networkLog.Debug("Link update", "interface", update.Link.Attrs().Name)
+			nm.requestScan()
+		case update := <-nm.addrUpdates:
+			nm.server.networkLog.Debug("Address update", "interface", update.LinkIndex, "addr", update.LinkAddress.IP, "new", update.NewAddr)
+			if isCGNATAddress(update.LinkAddress.IP.String()) {
+				nm.updateTailnetAddresses()
+			}
+			nm.requestScan()
+		case update := <-nm.routeUpdates:
+			// Filter out empty route updates
+			if update.Dst == nil && update.Src == nil && update.Gw == nil && len(update.ListFlags()) == 0 {
+				continue
+			}
+
+			nm.server.networkLog.Debug("Route update", "route", update.Route)
+			nm.requestScan()
+		case <-nm.done:
+			nm.server.networkLog.Info("Done watching network changes")
+			return
+		}
+	}
+}
+
+func (nm *NetworkMonitor) updateTailnetAddresses() {
+	if nm.onTailnetAddr == nil {
+		return
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		nm.server.networkLog.Error("Failed to list addresses", "err", err)
+		return
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if isCGNATAddress(addr.IP.String()) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	nm.onTailnetAddr(ips)
+}
+
+func (nm *NetworkMonitor) Start(onPeers func([]NetworkInfo), onTailnetAddrs func([]net.IP)) error {
+	nm.onUpdate = onPeers
+	nm.onTailnetAddr = onTailnetAddrs
+	if err := nm.subscribe(); err != nil {
+		return err
+	}
+	go nm.watchNetworkChanges()
+	go nm.scanWorker()
+	// Initial update
+	nm.updateTailnetAddresses()
+	nm.updateNetworkInfo()
+	return nil
+}
+
+func (nm *NetworkMonitor) Stop() {
+	nm.stopOnce.Do(func() { close(nm.done) })
+}
+
+func (nm *NetworkMonitor) Rescan() {
+	nm.updateNetworkInfo()
+}
+
+func (nm *NetworkMonitor) Peers() []NetworkInfo {
+	nm.mutex.RLock()
+	defer nm.mutex.RUnlock()
+	return nm.infos
+}
+
+func FindLocalCGNATAddress() (net.IP, error) {
+	networkLog := slog.Default().With("component", ComponentNetwork)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interfaces: %w", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			networkLog.Warn("Failed to get addresses for interface", "interface", iface.Name, "err", err)
+			continue
+		}
+
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+
+			if ip.To4() != nil && ip.To4()[0] == 100 && (ip.To4()[1]&0xC0) == 64 {
+				networkLog.Debug("Found CGNAT address", "addr", ip, "interface", iface.Name)
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no CGNAT address found")
+}
+
+func getHostnameWithRetry(ctx context.Context, resolver *hostnameResolver, ip string) (peerName, error) {
+	const maxRetries = 3
+	const initialBackoff = time.Second
+
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := initialBackoff * time.Duration(1<<uint(attempt))
+			select {
+			case <-ctx.Done():
+				return peerName{}, fmt.Errorf("attempt %d: %w", attempt+1, ctx.Err())
+			case <-time.After(backoff):
+			}
+		}
+
+		name, err := resolver.lookup(ctx, ip)
+		if err != nil {
+			lastErr = fmt.Errorf("attempt %d: %w", attempt+1, err)
+			continue
+		}
+		return name, nil
+	}
+	return peerName{}, fmt.Errorf("all attempts failed: %w", lastErr)
+}
@@ -0,0 +1,330 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File offers. A peer offers a file as
+// "FILE_OFFER:<id>:<name>:<size>[:<mime type>]" and streams it with
+// FILE_START once the offer is acknowledged with ACK:<id>:DONE. Offers that
+// need consent are passed to the subscribers as
+// "FILE_OFFER:<id>:<json FileOffer>", which answer with "ACCEPT:<id>" or
+// "REJECT:<id>". The outcome is passed to the subscribers as
+// "FILE_OFFER_CLOSED:<id>:<accepted|rejected|timeout>". A FILE_START that
+// was not offered is the offer, with its data waiting in the connection
+// until the offer is decided.
+const (
+	fileOfferPrefix       = "FILE_OFFER:"
+	fileOfferClosedPrefix = "FILE_OFFER_CLOSED:"
+	acceptPrefix          = "ACCEPT:"
+	rejectPrefix          = "REJECT:"
+
+	rejectOfferRejected = "rejected"
+	rejectOfferTimeout  = "offer_timeout"
+	rejectNoSubscriber  = "no_subscriber"
+	rejectInvalidName   = "invalid_name"
+	rejectQuotaExceeded = "quota_exceeded"
+	rejectShuttingDown  = "shutting_down"
+
+	// fileOfferWait is how long a sender waits for the peer to decide on
+	// an offer, longer than the default offer timeout.
+	fileOfferWait = 5 * time.Minute
+)
+
+// errOfferRequired is returned by admit for a FILE_START that was not
+// offered and accepted.
+var errOfferRequired = errors.New("file was not offered and accepted")
+
+// fileRejectedError rejects a FILE_START. The file data follows and cannot
+// be skipped, so the connection is closed after the reply.
+type fileRejectedError struct {
+	reason string
+}
+
+func (e *fileRejectedError) Error() string {
+	return "file rejected: " + e.reason
+}
+
+// FileOffer is an incoming file waiting for a subscriber to accept it.
+type FileOffer struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	MIME string    `json:"mime"`
+	Peer string    `json:"peer"` // Remote address of the peer connection.
+	Time time.Time `json:"time"`
+}
+
+type pendingOffer struct {
+	FileOffer
+	decision chan bool // Buffered. True if accepted.
+}
+
+// acceptedOffer is an accepted offer waiting for its FILE_START.
+type acceptedOffer struct {
+	name    string
+	size    int64
+	expires time.Time
+}
+
+// offerTable holds the pending and the accepted file offers.
+type offerTable struct {
+	server *Server
+
+	mutex    sync.Mutex
+	pending  map[string]*pendingOffer // Offer id -> offer.
+	accepted map[string]acceptedOffer // Peer address and offer id -> offer.
+}
+
+func newOfferTable(s *Server) *offerTable {
+	return &offerTable{
+		server:   s,
+		pending:  make(map[string]*pendingOffer),
+		accepted: make(map[string]acceptedOffer),
+	}
+}
+
+func offerKey(addr netip.Addr, id string) string {
+	return addr.String() + " " + id
+}
+
+// fileMIMEType returns the MIME type of a file by the extension of its
+// name.
+func fileMIMEType(name string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+// matches returns if a file of size from the peer at addr is accepted by r.
+func (r *FileRule) matches(addr netip.Addr, size int64) bool {
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return false
+	}
+	if len(r.peers) == 0 {
+		return true
+	}
+	for _, prefix := range r.peers {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// autoAccept returns if a file of size from the peer at addr is accepted
+// without asking.
+func (c *FilesConfig) autoAccept(addr netip.Addr, size int64) bool {
+	if !c.Consent {
+		return true
+	}
+	for i := range c.AutoAccept {
+		if c.AutoAccept[i].matches(addr, size) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleOffer decides on a FILE_OFFER from the peer of conn, waiting for a
+// subscriber if needed. It returns nil if the file is accepted.
+func (o *offerTable) handleOffer(conn net.Conn, body string) error {
+	parts := strings.SplitN(body, ":", 4)
+	if len(parts) < 3 {
+		return &rejectedError{rejectOfferRejected}
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || size < 0 || !validFileName(parts[1]) {
+		return &rejectedError{rejectOfferRejected}
+	}
+	offer := FileOffer{
+		ID:   parts[0],
+		Name: parts[1],
+		Size: size,
+		Peer: conn.RemoteAddr().String(),
+		Time: time.Now(),
+	}
+	if len(parts) > 3 && parts[3] != "" {
+		offer.MIME = parts[3]
+	} else {
+		offer.MIME = fileMIMEType(offer.Name)
+	}
+	return o.consent(conn, offer)
+}
+
+// consent decides on the offer from the peer of conn by the rules, or waits
+// for a subscriber. It returns nil if the file is accepted.
+func (o *offerTable) consent(conn net.Conn, offer FileOffer) error {
+	size := offer.Size
+	addr := remoteAddr(conn)
+	log := o.server.transferLog.With("id", offer.ID, "name", o.server.sensitive(offer.Name), "size", size, "remote", offer.Peer)
+
+	cfg := o.server.Config()
+	if err := o.server.checkQuota(&cfg.Quota, size); err != nil {
+		log.Warn("File offer over quota", "err", err)
+		o.server.metrics.fileOffers.Inc(rejectQuotaExceeded)
+		return &rejectedError{rejectQuotaExceeded}
+	}
+	if cfg.Files.autoAccept(addr, size) {
+		log.Info("File offer accepted by the rules")
+		o.server.metrics.fileOffers.Inc("auto_accepted")
+		o.accept(addr, offer, cfg.Files.OfferTimeout)
+		return nil
+	}
+
+	pending := &pendingOffer{FileOffer: offer, decision: make(chan bool, 1)}
+	o.mutex.Lock()
+	if _, ok := o.pending[offer.ID]; ok {
+		o.mutex.Unlock()
+		return &rejectedError{rejectOfferRejected}
+	}
+	o.pending[offer.ID] = pending
+	o.mutex.Unlock()
+	defer func() {
+		o.mutex.Lock()
+		delete(o.pending, offer.ID)
+		o.mutex.Unlock()
+	}()
+
+	data, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	if !o.server.hasSubscribers() {
+		log.Info("File offer rejected without subscribers")
+		o.server.metrics.fileOffers.Inc(rejectNoSubscriber)
+		return &rejectedError{rejectNoSubscriber}
+	}
+	e, err := o.server.peerEvent(conn, fileOfferPrefix+offer.ID+":"+string(data))
+	if err != nil {
+		return err
+	}
+	log.Info("File offer waiting for consent")
+	o.server.broadcastEvent(e)
+
+	timer := time.NewTimer(cfg.Files.OfferTimeout)
+	defer timer.Stop()
+	result, reason := "timeout", rejectOfferTimeout
+	select {
+	case accepted := <-pending.decision:
+		if accepted {
+			result, reason = "accepted", ""
+		} else {
+			result, reason = "rejected", rejectOfferRejected
+		}
+	case <-timer.C:
+	case <-o.server.shutdownCtx.Done():
+		result, reason = "rejected", rejectShuttingDown
+	}
+	log.Info("File offer closed", "result", result)
+	o.server.metrics.fileOffers.Inc(result)
+	o.server.broadcastMessage(fileOfferClosedPrefix + offer.ID + ":" + result)
+	if reason != "" {
+		return &rejectedError{reason}
+	}
+	o.accept(addr, offer, cfg.Files.OfferTimeout)
+	return nil
+}
+
+// accept lets the peer at addr stream the offered file within timeout.
+func (o *offerTable) accept(addr netip.Addr, offer FileOffer, timeout time.Duration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	now := time.Now()
+	for key, accepted := range o.accepted {
+		if now.After(accepted.expires) {
+			delete(o.accepted, key)
+		}
+	}
+	o.accepted[offerKey(addr, offer.ID)] = acceptedOffer{name: offer.Name, size: offer.Size, expires: now.Add(timeout)}
+}
+
+// admit checks a FILE_START from the peer at addr against the accepted
+// offers, which must have the same name and size, and the rules.
+func (o *offerTable) admit(addr netip.Addr, id, name string, size int64) error {
+	key := offerKey(addr, id)
+	o.mutex.Lock()
+	accepted, ok := o.accepted[key]
+	delete(o.accepted, key)
+	o.mutex.Unlock()
+	if ok && accepted.name == name && accepted.size == size && time.Now().Before(accepted.expires) {
+		return nil
+	}
+	cfg := &o.server.Config().Files
+	if cfg.autoAccept(addr, size) {
+		return nil
+	}
+	return errOfferRequired
+}
+
+// admitFile checks a FILE_START from the peer of conn. A file that was not
+// offered and accepted is offered now, holding its data in the connection
+// until the offer is decided.
+func (s *Server) admitFile(conn net.Conn, id, name string, size int64) error {
+	addr := remoteAddr(conn)
+	err := s.offers.admit(addr, id, name, size)
+	if errors.Is(err, errOfferRequired) {
+		err = s.offers.consent(conn, FileOffer{
+			ID:   id,
+			Name: name,
+			Size: size,
+			MIME: fileMIMEType(name),
+			Peer: conn.RemoteAddr().String(),
+			Time: time.Now(),
+		})
+		if err == nil {
+			err = s.offers.admit(addr, id, name, size)
+		}
+	}
+	var rejected *rejectedError
+	if errors.As(err, &rejected) {
+		return &fileRejectedError{rejected.reason}
+	}
+	if err != nil {
+		return fmt.Errorf("file %v rejected: %w", id, err)
+	}
+	return nil
+}
+
+// decide accepts or rejects the pending offer with id.
+func (o *offerTable) decide(id string, accept bool) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	pending, ok := o.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending offer %q", id)
+	}
+	select {
+	case pending.decision <- accept:
+	default:
+		// Already decided by another subscriber.
+	}
+	return nil
+}
+
+// list returns the pending offers, oldest first.
+func (o *offerTable) list() []FileOffer {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	offers := make([]FileOffer, 0, len(o.pending))
+	for _, pending := range o.pending {
+		offers = append(offers, pending.FileOffer)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Time.Before(offers[j].Time) })
+	return offers
+}
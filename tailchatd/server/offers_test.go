@@ -0,0 +1,149 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectTestSubscriber connects a legacy subscriber to s and returns it
+// once it is registered.
+func connectTestSubscriber(t *testing.T, s *Server) *testPeer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serveSubscribers(listener, false)
+	sub := dialTestPeer(t, listener.Addr().String())
+	for deadline := time.Now().Add(5 * time.Second); len(s.adminSubscribers()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return sub
+}
+
+// offer returns the next file offer passed to the subscriber.
+func (p *testPeer) offer() FileOffer {
+	p.t.Helper()
+	for {
+		line := p.reply()
+		if body, ok := strings.CutPrefix(line, fileOfferPrefix); ok {
+			_, data, _ := strings.Cut(body, ":")
+			var offer FileOffer
+			if err := json.Unmarshal([]byte(data), &offer); err != nil {
+				p.t.Fatalf("invalid offer %q: %v", line, err)
+			}
+			return offer
+		}
+	}
+}
+
+func TestFileStartWithoutOffer(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Files.Consent = true
+	})
+	sub := connectTestSubscriber(t, s)
+	addr := serveTestChat(t, s)
+
+	// The FILE_START is held as an offer until it is accepted.
+	peer := dialTestPeer(t, addr)
+	peer.write("FILE_START:f1:a.txt:5\nabcde")
+	if offer := sub.offer(); offer.ID != "f1" || offer.Name != "a.txt" || offer.Size != 5 {
+		t.Fatalf("offer = %+v", offer)
+	}
+	sub.write("ACCEPT:f1\n")
+	if reply := peer.reply(); reply != "ACK:f1:DONE" {
+		t.Fatalf("reply = %q, want ACK:f1:DONE", reply)
+	}
+
+	// A rejected one closes the connection, as its data cannot be skipped.
+	peer.write("FILE_START:f2:b.txt:5\nabcde")
+	if offer := sub.offer(); offer.ID != "f2" {
+		t.Fatalf("offer = %+v", offer)
+	}
+	sub.write("REJECT:f2\n")
+	if reply := peer.reply(); reply != errorMessage("f2", rejectOfferRejected) {
+		t.Fatalf("reply = %q, want %q", reply, errorMessage("f2", rejectOfferRejected))
+	}
+	if _, err := peer.lines.ReadString('\n'); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+func TestFileStartName(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Files.Consent = true
+	})
+	sub := connectTestSubscriber(t, s)
+	addr := serveTestChat(t, s)
+
+	// An accepted offer only admits the file with the offered name.
+	peer := dialTestPeer(t, addr)
+	peer.write("FILE_OFFER:f1:a.txt:5\n")
+	sub.offer()
+	sub.write("ACCEPT:f1\n")
+	if reply := peer.reply(); reply != "ACK:f1:DONE" {
+		t.Fatalf("reply = %q, want ACK:f1:DONE", reply)
+	}
+	peer.write("FILE_START:f1:b.txt:5\nabcde")
+	if offer := sub.offer(); offer.ID != "f1" || offer.Name != "b.txt" {
+		t.Fatalf("offer = %+v, want a new offer of b.txt", offer)
+	}
+	sub.write("REJECT:f1\n")
+	if reply := peer.reply(); reply != errorMessage("f1", rejectOfferRejected) {
+		t.Fatalf("reply = %q, want %q", reply, errorMessage("f1", rejectOfferRejected))
+	}
+
+	offers := dialTestPeer(t, addr)
+	names := []string{"../a.txt", `..\a.txt`, "a/b.txt", "..", ".hidden", "a.txt.part", "a.txt.part.json"}
+	for _, name := range append(names, reservedFileNames...) {
+		offers.write("FILE_OFFER:f2:" + name + ":5\n")
+		if reply := offers.reply(); reply != errorMessage("f2", rejectOfferRejected) {
+			t.Errorf("%q: offer reply = %q, want %q", name, reply, errorMessage("f2", rejectOfferRejected))
+		}
+		peer := dialTestPeer(t, addr)
+		peer.write("FILE_START:f3:" + name + ":5\nabcde")
+		if reply := peer.reply(); reply != errorMessage("f3", rejectInvalidName) {
+			t.Errorf("%q: reply = %q, want %q", name, reply, errorMessage("f3", rejectInvalidName))
+		}
+	}
+}
+
+func TestDirStorageFileName(t *testing.T) {
+	storage, err := NewDirStorage(t.TempDir(), "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"", "../a.txt", `..\a.txt`, "a/b.txt", "/etc/passwd", "..", "buffer", ".hidden", "a.txt.part", "a.txt.part.json"}
+	for _, name := range append(names, reservedFileNames...) {
+		if file, err := storage.CreateFile(name); err == nil {
+			file.Abort()
+			t.Errorf("CreateFile(%q) succeeded", name)
+		}
+	}
+	file, err := storage.CreateFile("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	path, err := file.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(storage.dir, filesDir, "a.txt"); path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+}
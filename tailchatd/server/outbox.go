@@ -0,0 +1,710 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cylonix.io/tailchatd/lantls"
+)
+
+// Outbound message statuses, reported to the subscribers as
+// "SEND_STATUS:<id>:<json>".
+const (
+	OutboundQueued    = "queued"
+	OutboundSending   = "sending"
+	OutboundDelivered = "delivered"
+	OutboundFailed    = "failed"
+)
+
+const (
+	sendPrefix       = "SEND:"
+	sendStatusPrefix = "SEND_STATUS:"
+	defaultChatPort  = "50311"
+)
+
+// OutboundMessage is a message or file queued for delivery to a peer.
+type OutboundMessage struct {
+	ID        string    `json:"id"`
+	Peer      string    `json:"peer"` // host:port. The port defaults to 50311.
+	Type      string    `json:"type"` // TEXT, CTRL or FILE. GROUP_SYNC or RECEIPT when queued by the daemon.
+	Body      string    `json:"body,omitempty"`
+	Path      string    `json:"path,omitempty"`  // FILE only. Read when sent.
+	Name      string    `json:"name,omitempty"`  // FILE only. Defaults to the base name of Path.
+	Group     string    `json:"group,omitempty"` // Set instead of Peer to send to the members of a group.
+	Queued    time.Time `json:"queued"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// OutboundStatus is the body of a SEND_STATUS message.
+type OutboundStatus struct {
+	Status   string `json:"status"`
+	Peer     string `json:"peer"`
+	Group    string `json:"group,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// permanentError is a delivery error that retrying does not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// peerQueue holds the messages for one peer, delivered in order by one
+// goroutine while it is not empty.
+type peerQueue struct {
+	peer     string
+	messages []*OutboundMessage
+	wake     chan struct{}
+	running  bool
+}
+
+// outbox queues the messages from the local subscribers for the peers and
+// delivers them, retrying with a backoff while the peer is unreachable. The
+// queue is saved to the storage on every change so that it survives
+// restarts.
+type outbox struct {
+	server *Server
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// reportMutex keeps the statuses of a message in order, the queued one
+	// being reported before its delivery starts.
+	reportMutex sync.Mutex
+
+	mutex  sync.Mutex
+	queues map[string]*peerQueue
+	byKey  map[string]*OutboundMessage
+	closed bool
+}
+
+func newOutbox(s *Server) *outbox {
+	o := &outbox{
+		server: s,
+		queues: make(map[string]*peerQueue),
+		byKey:  make(map[string]*OutboundMessage),
+	}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+	return o
+}
+
+// start loads the saved queue and starts delivering it.
+func (o *outbox) start() {
+	messages, err := o.server.storage.LoadOutbox()
+	if err != nil {
+		o.server.outboxLog.Error("Failed to load the outbox", "err", o.server.redactPath(err))
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for i := range messages {
+		m := &messages[i]
+		m.Status = OutboundQueued
+		o.addLocked(m)
+	}
+	if len(messages) > 0 {
+		o.server.outboxLog.Info("Outbox loaded", "count", len(messages))
+	}
+}
+
+// stop stops the deliveries. Messages being sent stay queued.
+func (o *outbox) stop() {
+	o.mutex.Lock()
+	o.closed = true
+	o.mutex.Unlock()
+	o.cancel()
+	o.wg.Wait()
+}
+
+// normalizePeer adds the default chat port to peer if it has none.
+func normalizePeer(peer string) string {
+	if _, _, err := net.SplitHostPort(peer); err == nil {
+		return peer
+	}
+	return net.JoinHostPort(strings.Trim(peer, "[]"), defaultChatPort)
+}
+
+// validate checks a message handed to the outbox by a subscriber.
+func (m *OutboundMessage) validate() error {
+	if m.ID == "" || strings.ContainsAny(m.ID, ":\n") {
+		return fmt.Errorf("invalid id %q", m.ID)
+	}
+	if m.Group != "" {
+		if m.Type != "TEXT" {
+			return fmt.Errorf("group messages must be TEXT: %q", m.Type)
+		}
+	} else if m.Peer == "" {
+		return errors.New("peer or group must be set")
+	}
+	switch m.Type {
+	case "TEXT", "CTRL":
+		if strings.Contains(m.Body, "\n") {
+			return errors.New("body must be a single line")
+		}
+	case "FILE":
+		if !filepath.IsAbs(m.Path) {
+			return fmt.Errorf("path must be absolute: %q", m.Path)
+		}
+		if m.Name == "" {
+			m.Name = filepath.Base(m.Path)
+		}
+		if strings.ContainsAny(m.Name, ":/\n") {
+			return fmt.Errorf("name must not contain ':', '/' or newlines: %q", m.Name)
+		}
+	default:
+		return fmt.Errorf("type must be TEXT, CTRL or FILE: %q", m.Type)
+	}
+	return nil
+}
+
+// internal returns if m was queued by the daemon itself, whose status is
+// not reported to the subscribers.
+func (m *OutboundMessage) internal() bool {
+	return m.Type == "GROUP_SYNC" || m.Type == "RECEIPT"
+}
+
+// key identifies a queued message. The copies of a group message share the
+// id.
+func (m *OutboundMessage) key() string {
+	return m.ID + " " + m.Peer
+}
+
+// enqueue queues m from a subscriber for delivery and returns it as queued.
+// A group message is fanned out to the members of the group and returned
+// without a peer.
+func (o *outbox) enqueue(m OutboundMessage) (OutboundMessage, error) {
+	m.Type = strings.ToUpper(m.Type)
+	if m.Group == "" {
+		m.Peer = normalizePeer(m.Peer)
+	}
+	if err := m.validate(); err != nil {
+		return m, err
+	}
+	if m.Type == "FILE" {
+		path, err := sendPath(o.server.Config().Outbox.SendDir, m.Path)
+		if err != nil {
+			return m, err
+		}
+		m.Path = path
+	}
+	if m.Group == "" {
+		if !o.server.knownPeer(m.Peer) {
+			return m, fmt.Errorf("unknown peer %q", m.Peer)
+		}
+		queued, err := o.add([]OutboundMessage{m})
+		if err != nil {
+			return m, err
+		}
+		return queued[0], nil
+	}
+	peers, err := o.server.groups.fanOut(m.Group)
+	if err != nil {
+		return m, err
+	}
+	messages := make([]OutboundMessage, len(peers))
+	for i, peer := range peers {
+		if !o.server.knownPeer(peer) {
+			return m, fmt.Errorf("unknown peer %q in group %q", peer, m.Group)
+		}
+		messages[i] = m
+		messages[i].Peer = peer
+	}
+	if _, err := o.add(messages); err != nil {
+		return m, err
+	}
+	m.Status = OutboundQueued
+	m.Queued = time.Now()
+	return m, nil
+}
+
+// sendPath resolves the symlinks of path and returns it if the file is in
+// dir, the directory files may be sent from.
+func sendPath(dir, path string) (string, error) {
+	if dir == "" {
+		return "", errors.New("sending files is disabled: outbox.send_dir is not set")
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid outbox.send_dir: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("path is not in outbox.send_dir")
+	}
+	return resolved, nil
+}
+
+// knownPeer returns if peer, a host:port, is in the peer table. The port
+// must be the chat port, or the port a LAN peer advertised.
+func (s *Server) knownPeer(peer string) bool {
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return false
+	}
+	host = strings.TrimSuffix(host, ".")
+	addr, addrErr := netip.ParseAddr(host)
+	for _, info := range s.discovery.Peers() {
+		if port != defaultChatPort && (info.Port == 0 || port != strconv.Itoa(info.Port)) {
+			continue
+		}
+		if peerAddr, err := netip.ParseAddr(info.Address); err == nil && addrErr == nil && peerAddr.Unmap() == addr.Unmap() {
+			return true
+		}
+		for _, name := range []string{info.Hostname, info.FQDN, info.MachineName} {
+			if name != "" && strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add queues messages for delivery, all or none of them, and returns them
+// as queued.
+func (o *outbox) add(messages []OutboundMessage) ([]OutboundMessage, error) {
+	now := time.Now()
+	for i := range messages {
+		m := &messages[i]
+		m.Queued = now
+		m.Status = OutboundQueued
+		m.Attempts = 0
+		m.LastError = ""
+	}
+
+	o.reportMutex.Lock()
+	defer o.reportMutex.Unlock()
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return nil, errors.New("shutting down")
+	}
+	for i := range messages {
+		if _, ok := o.byKey[messages[i].key()]; ok {
+			o.mutex.Unlock()
+			return nil, fmt.Errorf("id %q is already queued", messages[i].ID)
+		}
+	}
+	if max := o.server.Config().Outbox.MaxMessages; max > 0 && len(o.byKey)+len(messages) > max {
+		o.mutex.Unlock()
+		return nil, fmt.Errorf("outbox is full with %d messages", max)
+	}
+	for i := range messages {
+		queued := messages[i]
+		o.addLocked(&queued)
+	}
+	o.saveLocked()
+	o.mutex.Unlock()
+
+	for _, m := range messages {
+		o.server.outboxLog.Info("Message queued", "id", m.ID, "type", m.Type, "peer", o.server.sensitive(m.Peer), "group", m.Group)
+		o.reportLocked(m, nil)
+	}
+	return messages, nil
+}
+
+func (o *outbox) addLocked(m *OutboundMessage) {
+	q := o.queues[m.Peer]
+	if q == nil {
+		q = &peerQueue{peer: m.Peer, wake: make(chan struct{}, 1)}
+		o.queues[m.Peer] = q
+	}
+	q.messages = append(q.messages, m)
+	o.byKey[m.key()] = m
+	if !q.running {
+		q.running = true
+		o.wg.Add(1)
+		go o.run(q)
+	}
+}
+
+// removeLocked drops m from its queue. It returns false if it was not
+// queued anymore.
+func (o *outbox) removeLocked(m *OutboundMessage) bool {
+	if o.byKey[m.key()] != m {
+		return false
+	}
+	delete(o.byKey, m.key())
+	q := o.queues[m.Peer]
+	for i, queued := range q.messages {
+		if queued == m {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// cancelMessage drops the messages with id, the copies of a group message
+// included, and returns how many were dropped. A delivery in progress is
+// not interrupted but its result is ignored.
+func (o *outbox) cancelMessage(id string) int {
+	o.mutex.Lock()
+	var canceled []OutboundMessage
+	for _, m := range o.byKey {
+		if m.ID != id {
+			continue
+		}
+		o.removeLocked(m)
+		m.Status = OutboundFailed
+		m.LastError = "canceled"
+		canceled = append(canceled, *m)
+	}
+	if len(canceled) > 0 {
+		o.saveLocked()
+	}
+	o.mutex.Unlock()
+	for _, m := range canceled {
+		o.server.outboxLog.Info("Message canceled", "id", id, "peer", o.server.sensitive(m.Peer))
+		o.server.metrics.outboundMessages.Inc(OutboundFailed)
+		o.report(m, errors.New("canceled"))
+	}
+	return len(canceled)
+}
+
+func (o *outbox) saveLocked() {
+	messages := []OutboundMessage{}
+	for _, q := range o.queues {
+		for _, m := range q.messages {
+			messages = append(messages, *m)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Queued.Before(messages[j].Queued) })
+	if err := o.server.storage.SaveOutbox(messages); err != nil {
+		o.server.outboxLog.Error("Failed to save the outbox", "err", o.server.redactPath(err))
+	}
+}
+
+// list returns the queued messages, oldest first.
+func (o *outbox) list() []OutboundMessage {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	messages := []OutboundMessage{}
+	for _, m := range o.byKey {
+		messages = append(messages, *m)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Queued.Before(messages[j].Queued) })
+	return messages
+}
+
+// len returns the number of queued messages.
+func (o *outbox) len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.byKey)
+}
+
+// wakeHost retries the deliveries to the peer known by any of names right
+// away, as it was seen online.
+func (o *outbox) wakeHost(names ...string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for peer, q := range o.queues {
+		host, _, _ := net.SplitHostPort(peer)
+		for _, name := range names {
+			if name != "" && strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				select {
+				case q.wake <- struct{}{}:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+// wakePeers retries the deliveries to the peers in the peer table.
+func (o *outbox) wakePeers(info []NetworkInfo) {
+	for _, peer := range info {
+		o.wakeHost(peer.Address, peer.Hostname, peer.FQDN, peer.MachineName)
+	}
+}
+
+// run delivers the messages of q in order until it is empty.
+func (o *outbox) run(q *peerQueue) {
+	defer o.wg.Done()
+	cfg := &o.server.Config().Outbox
+	backoff := cfg.RetryBackoff
+	for {
+		o.mutex.Lock()
+		if len(q.messages) == 0 || o.closed {
+			q.running = false
+			if len(q.messages) == 0 {
+				delete(o.queues, q.peer)
+			}
+			o.mutex.Unlock()
+			return
+		}
+		m := q.messages[0]
+		cfg = &o.server.Config().Outbox
+		if cfg.MaxAge > 0 && time.Since(m.Queued) > cfg.MaxAge {
+			o.removeLocked(m)
+			m.Status = OutboundFailed
+			o.saveLocked()
+			expired := *m
+			o.mutex.Unlock()
+			o.server.outboxLog.Warn("Message expired", "id", m.ID, "peer", o.server.sensitive(m.Peer), "attempts", expired.Attempts, "err", expired.LastError)
+			o.server.metrics.outboundMessages.Inc(OutboundFailed)
+			o.report(expired, fmt.Errorf("not delivered within %v: %v", cfg.MaxAge, expired.LastError))
+			continue
+		}
+		m.Status = OutboundSending
+		m.Attempts++
+		sending := *m
+		o.mutex.Unlock()
+		o.report(sending, nil)
+
+		start := time.Now()
+		err := o.deliver(m)
+		if o.ctx.Err() != nil {
+			// Shutting down. The message stays queued.
+			o.mutex.Lock()
+			m.Status = OutboundQueued
+			q.running = false
+			o.mutex.Unlock()
+			return
+		}
+
+		o.mutex.Lock()
+		var permanent *permanentError
+		switch {
+		case err == nil || errors.As(err, &permanent):
+			if !o.removeLocked(m) {
+				o.mutex.Unlock()
+				continue // Canceled meanwhile.
+			}
+			m.Status = OutboundDelivered
+			if err != nil {
+				m.Status = OutboundFailed
+				m.LastError = err.Error()
+			}
+			o.saveLocked()
+			done := *m
+			o.mutex.Unlock()
+			o.server.metrics.outboundMessages.Inc(done.Status)
+			if err == nil {
+				o.server.outboxLog.Info("Message delivered", "id", m.ID, "peer", o.server.sensitive(m.Peer), "attempts", done.Attempts, "ms", time.Since(start).Milliseconds())
+			} else {
+				o.server.outboxLog.Error("Message failed", "id", m.ID, "peer", o.server.sensitive(m.Peer), "err", err)
+			}
+			o.report(done, err)
+			backoff = cfg.RetryBackoff
+			continue
+		}
+		m.Status = OutboundQueued
+		m.LastError = err.Error()
+		o.saveLocked()
+		retry := *m
+		o.mutex.Unlock()
+		o.server.outboxLog.Info("Delivery failed. Retrying", "id", m.ID, "peer", o.server.sensitive(m.Peer), "attempt", retry.Attempts, "backoff", backoff, "err", err)
+		o.server.metrics.outboundRetries.Inc()
+		o.report(retry, err)
+
+		// A peer woken with a push gets the wake window to connect. It
+		// wakes the queue when it does.
+		wait := backoff
+		var unreachable *unreachableError
+		if errors.As(err, &unreachable) && o.server.push.wake(o.ctx, m.Peer) {
+			wait = o.server.Config().Push.WakeWindow
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-o.ctx.Done():
+		case <-q.wake:
+			backoff = cfg.RetryBackoff
+		case <-timer.C:
+			if backoff *= 2; backoff > cfg.MaxBackoff {
+				backoff = cfg.MaxBackoff
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// report sends the status of m to the subscribers. The final statuses are
+// buffered if no subscriber is connected.
+func (o *outbox) report(m OutboundMessage, err error) {
+	o.reportMutex.Lock()
+	defer o.reportMutex.Unlock()
+	o.reportLocked(m, err)
+}
+
+func (o *outbox) reportLocked(m OutboundMessage, err error) {
+	if m.internal() {
+		return
+	}
+	status := OutboundStatus{Status: m.Status, Peer: m.Peer, Group: m.Group, Attempts: m.Attempts}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	data, jsonErr := json.Marshal(status)
+	if jsonErr != nil {
+		return
+	}
+	message := sendStatusPrefix + m.ID + ":" + string(data)
+	if status.Status == OutboundDelivered || status.Status == OutboundFailed {
+		o.server.broadcastOrBufferMessage(message)
+	} else {
+		o.server.broadcastMessage(message)
+	}
+}
+
+// deliver sends m to its peer and waits for the peer to acknowledge it.
+func (o *outbox) deliver(m *OutboundMessage) error {
+	timeout := o.server.Config().Outbox.Timeout
+	var file *os.File
+	var size int64
+	if m.Type == "FILE" {
+		// Resolved again, as the links may have changed since the message
+		// was queued.
+		path, err := sendPath(o.server.Config().Outbox.SendDir, m.Path)
+		if err != nil {
+			return &permanentError{o.server.redactPath(err)}
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return &permanentError{o.server.redactPath(err)}
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return &permanentError{o.server.redactPath(err)}
+		}
+		if !info.Mode().IsRegular() {
+			return &permanentError{errors.New("not a regular file")}
+		}
+		file, size = f, info.Size()
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(o.ctx, "tcp", m.Peer)
+	if err != nil {
+		return &unreachableError{err}
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(o.ctx, func() { conn.Close() })
+	defer stop()
+	if config := o.server.tlsClientConfig(m.Peer); config != nil {
+		tlsConn := tls.Client(conn, config)
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.HandshakeContext(o.ctx); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	// One reader for the connection, as it may buffer the lines after an
+	// ACK.
+	input := bufio.NewReader(conn)
+
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	switch {
+	case m.Group != "":
+		_, err = fmt.Fprintf(conn, "%s%s:%s:%s\n", groupTextPrefix, m.ID, m.Group, m.Body)
+	case file == nil:
+		_, err = fmt.Fprintf(conn, "%s:%s:%s\n", m.Type, m.ID, m.Body)
+	default:
+		// Offer the file first. A daemon without offers acknowledges the
+		// unknown message the same way as an accepted offer.
+		_, err = fmt.Fprintf(conn, "%s%s:%s:%d:%s\n", fileOfferPrefix, m.ID, m.Name, size, fileMIMEType(m.Name))
+		if err == nil {
+			if err := readAck(conn, input, m.ID, fileOfferWait); err != nil {
+				return err
+			}
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			_, err = fmt.Fprintf(conn, "%s%s:%s:%d\n", fileStartPrefix, m.ID, m.Name, size)
+		}
+		if err == nil {
+			// The peer acknowledges progress, so only a stall times out.
+			conn.SetWriteDeadline(time.Time{})
+			_, err = io.Copy(&deadlineWriter{conn: conn, timeout: timeout}, file)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send: %w", err)
+	}
+	return readAck(conn, input, m.ID, timeout)
+}
+
+// deadlineWriter extends the write deadline of conn before each write.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// readAck waits for the peer to finish handling the message id, reading
+// the lines of conn from input.
+func readAck(conn net.Conn, input *bufio.Reader, id string, timeout time.Duration) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := input.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read ACK: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "ACK:"+id+":DONE":
+			return nil
+		case line == shutdownMessage:
+			return errors.New("peer is shutting down")
+		case strings.HasPrefix(line, errorPrefix+id+":"), strings.HasPrefix(line, errorPrefix+"daemon:"):
+			reason := line[strings.LastIndex(line, ":")+1:]
+			err := fmt.Errorf("peer rejected the message: %v", reason)
+			switch reason {
+			case rejectMessageTooLarge, rejectNotMember, rejectInvalidGroup, rejectInvalidReceipt, rejectOfferRejected, rejectQuotaExceeded:
+				return &permanentError{err}
+			}
+			return err
+		}
+		// Progress ACKs of files and other lines.
+	}
+}
+
+// tlsClientConfig returns the TLS config to deliver to peer with, or nil
+// for plaintext. TLS is used when enabled and the peer is neither loopback
+// nor on the tailnet, with the peer keys pinned by host.
+func (s *Server) tlsClientConfig(peer string) *tls.Config {
+	if s.tlsHostPins == nil {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(peer)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if addr.IsLoopback() || isCGNATAddress(addr.String()) || tailnetIPv6Prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return lantls.ClientConfig(s.tlsCert, s.tlsHostPins, host, func(name, fingerprint string) {
+		s.outboxLog.Info("Pinned new peer key", "host", s.sensitive(name), "fingerprint", fingerprint)
+	})
+}
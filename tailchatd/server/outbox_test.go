@@ -0,0 +1,178 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDiscovery is a Discovery with a fixed peer table.
+type testDiscovery []NetworkInfo
+
+func (d testDiscovery) Start(func([]NetworkInfo), func([]net.IP)) error { return nil }
+func (d testDiscovery) Peers() []NetworkInfo                            { return d }
+func (d testDiscovery) Rescan()                                         {}
+func (d testDiscovery) Stop()                                           {}
+
+// newTestOutbox returns a server whose peer table has the peer at addr on
+// its port, delivering the files in the returned send directory. configure
+// may change the config.
+func newTestOutbox(t *testing.T, addr string, configure func(*Config)) (*Server, string) {
+	t.Helper()
+	sendDir := t.TempDir()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Outbox.SendDir = sendDir
+		cfg.Outbox.Timeout = 5 * time.Second
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	info := NetworkInfo{Address: host, Hostname: "peer", Source: "lan"}
+	info.Port, _ = net.LookupPort("tcp", port)
+	s.discovery = testDiscovery{info}
+	t.Cleanup(s.outbox.stop)
+	return s, sendDir
+}
+
+// waitOutboxEmpty waits for the outbox of s to deliver its messages.
+func waitOutboxEmpty(t *testing.T, s *Server) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.outbox.len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox not delivered: %+v", s.outbox.list())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutboxSendDir(t *testing.T) {
+	s, sendDir := newTestOutbox(t, "127.0.0.1:1", nil)
+	inside := filepath.Join(sendDir, "a.txt")
+	outside := filepath.Join(t.TempDir(), "b.txt")
+	for _, path := range []string{inside, outside} {
+		if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(sendDir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(inside, filepath.Join(t.TempDir(), "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path string
+		ok   bool
+	}{
+		{inside, true},
+		{outside, false},
+		{filepath.Join(sendDir, "link.txt"), false},
+		{filepath.Join(sendDir, "..", filepath.Base(filepath.Dir(outside)), "b.txt"), false},
+		{filepath.Join(sendDir, "missing.txt"), false},
+		{sendDir, false},
+		{"/etc/passwd", false},
+	} {
+		path, err := sendPath(sendDir, test.path)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("sendPath(%q) = %q, %v, want ok %v", test.path, path, err, test.ok)
+		}
+	}
+	if _, err := sendPath("", inside); err == nil {
+		t.Error("sendPath without send_dir succeeded")
+	}
+
+	_, err := s.outbox.enqueue(OutboundMessage{ID: "f1", Peer: "127.0.0.1:1", Type: "FILE", Path: outside})
+	if err == nil || s.outbox.len() != 0 {
+		t.Errorf("enqueue of a file outside send_dir: %v, queued %d", err, s.outbox.len())
+	}
+}
+
+func TestOutboxKnownPeers(t *testing.T) {
+	s, _ := newTestOutbox(t, "127.0.0.1:4000", nil)
+	s.discovery = append(s.discovery.(testDiscovery), NetworkInfo{Address: "100.64.0.2", Hostname: "tail", FQDN: "tail.example.ts.net."})
+	for _, test := range []struct {
+		peer string
+		ok   bool
+	}{
+		{"127.0.0.1:4000", true},
+		{"peer:4000", true},
+		{"127.0.0.1:4001", false},
+		{"100.64.0.2:50311", true},
+		{"tail:50311", true},
+		{"TAIL.example.ts.net:50311", true},
+		{"100.64.0.2:22", false},
+		{"100.64.0.3:50311", false},
+		{"169.254.169.254:80", false},
+	} {
+		if ok := s.knownPeer(test.peer); ok != test.ok {
+			t.Errorf("knownPeer(%q) = %v, want %v", test.peer, ok, test.ok)
+		}
+	}
+
+	_, err := s.outbox.enqueue(OutboundMessage{ID: "t1", Peer: "100.64.0.3", Type: "TEXT", Body: "hi"})
+	if err == nil || s.outbox.len() != 0 {
+		t.Errorf("enqueue to an unknown peer: %v, queued %d", err, s.outbox.len())
+	}
+}
+
+func TestOutboxDeliverFile(t *testing.T) {
+	receiver := newTestServer(t, nil)
+	addr := serveTestChat(t, receiver)
+	s, sendDir := newTestOutbox(t, addr, nil)
+	if err := os.WriteFile(filepath.Join(sendDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.outbox.enqueue(OutboundMessage{ID: "f1", Peer: addr, Type: "FILE", Path: filepath.Join(sendDir, "a.txt")}); err != nil {
+		t.Fatal(err)
+	}
+	waitOutboxEmpty(t, s)
+	data, err := os.ReadFile(filepath.Join(receiver.Config().Storage.CacheDir, filesDir, "a.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("received %q, %v, want hello", data, err)
+	}
+}
+
+// TestOutboxReadAck checks that the ACKs are read from one reader per
+// connection, with a peer writing the ACKs of the offer and of the file at
+// once.
+func TestOutboxReadAck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		input := bufio.NewReader(conn)
+		line, err := input.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, fileOfferPrefix+"f1:") {
+			return
+		}
+		conn.Write([]byte("ACK:f1:DONE\nACK:f1:DONE\n"))
+		input.ReadString('\n')
+		time.Sleep(time.Second)
+	}()
+
+	s, sendDir := newTestOutbox(t, listener.Addr().String(), nil)
+	if err := os.WriteFile(filepath.Join(sendDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &OutboundMessage{ID: "f1", Peer: listener.Addr().String(), Type: "FILE", Path: filepath.Join(sendDir, "a.txt"), Name: "a.txt"}
+	if err := s.outbox.deliver(m); err != nil {
+		t.Errorf("deliver: %v", err)
+	}
+}
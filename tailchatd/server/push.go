@@ -0,0 +1,322 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pushRateLimit is how long pnserver refuses further pushes to a device
+	// after one, if it does not say with Retry-After.
+	pushRateLimit = 30 * time.Second
+
+	// pushRetryAfterError is how long a device is not pushed again after
+	// pnserver failed or refused the push for another reason.
+	pushRetryAfterError = 5 * time.Minute
+
+	// pnInfoPrefix starts the TEXT body with which the app announces its
+	// push device as "PN_INFO:<hostname> <uuid>".
+	pnInfoPrefix = "PN_INFO:"
+
+	pushMaxResponseBytes = 1024
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// pushRequest is the body of POST /apn/tailchat on pnserver.
+type pushRequest struct {
+	Sender         string `json:"sender"`
+	Receiver       string `json:"receiver"`
+	SenderHostname string `json:"sender_hostname"`
+	SenderID       string `json:"sender_id"`
+	ReceiverID     string `json:"receiver_id"`
+	MessageType    string `json:"message_type"`
+	Message        string `json:"message"`
+}
+
+// unreachableError is a delivery error of a peer that could not be
+// connected to, which may be a suspended mobile device.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string { return e.err.Error() }
+func (e *unreachableError) Unwrap() error { return e.err }
+
+// pushNotifier wakes the suspended peers with a connection request sent
+// through pnserver, to the push device registered for the peer by its
+// hostname or address.
+type pushNotifier struct {
+	server *Server
+	client *http.Client
+
+	mutex   sync.Mutex
+	devices map[string]string    // Peer name -> push device UUID.
+	next    map[string]time.Time // Push device UUID -> earliest next push.
+}
+
+func newPushNotifier(s *Server) *pushNotifier {
+	return &pushNotifier{
+		server:  s,
+		client:  &http.Client{},
+		devices: make(map[string]string),
+		next:    make(map[string]time.Time),
+	}
+}
+
+// load loads the saved push devices.
+func (p *pushNotifier) load() {
+	devices, err := p.server.storage.LoadPushDevices()
+	if err != nil {
+		p.server.outboxLog.Error("Failed to load the push devices", "err", p.server.redactPath(err))
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, id := range devices {
+		p.devices[name] = id
+	}
+}
+
+// normalizePeerName returns the key of peer in the device table.
+func normalizePeerName(peer string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.Trim(peer, "[]"), "."))
+}
+
+// setDevice registers the push device id for the peer named name, or
+// removes it if id is empty.
+func (p *pushNotifier) setDevice(name, id string) error {
+	name = normalizePeerName(name)
+	if name == "" {
+		return fmt.Errorf("peer must not be empty")
+	}
+	if id != "" && !uuidPattern.MatchString(id) {
+		return fmt.Errorf("invalid push device id %q", id)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.devices[name] == id {
+		return nil
+	}
+	if id == "" {
+		delete(p.devices, name)
+	} else {
+		p.devices[name] = id
+	}
+	if err := p.server.storage.SavePushDevices(p.devices); err != nil {
+		return fmt.Errorf("failed to save the push devices: %w", p.server.redactPath(err))
+	}
+	p.server.outboxLog.Info("Push device updated", "peer", p.server.sensitive(name), "id", id)
+	return nil
+}
+
+// list returns the registered push devices by peer name.
+func (p *pushNotifier) list() map[string]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	devices := make(map[string]string, len(p.devices))
+	for name, id := range p.devices {
+		devices[name] = id
+	}
+	return devices
+}
+
+// learn registers the push device announced by the peer of conn in a TEXT
+// message. It returns if body was an announcement, which is not passed on as
+// chat text. The device is only registered for a hostname of the peer
+// itself.
+func (p *pushNotifier) learn(conn net.Conn, body string) bool {
+	info, ok := strings.CutPrefix(body, pnInfoPrefix)
+	if !ok {
+		return false
+	}
+	hostname, id, ok := strings.Cut(info, " ")
+	if !ok {
+		p.server.outboxLog.Warn("Invalid push device from peer", "remote", conn.RemoteAddr().String())
+		return true
+	}
+	if !p.resolvesTo(hostname, remoteAddr(conn)) {
+		p.server.outboxLog.Warn("Ignoring push device for another host", "remote", conn.RemoteAddr().String(), "peer", p.server.sensitive(hostname))
+		return true
+	}
+	if err := p.setDevice(hostname, id); err != nil {
+		p.server.outboxLog.Warn("Invalid push device from peer", "err", err)
+	}
+	return true
+}
+
+// resolvesTo returns if the peer named host has the address addr, by the
+// peer table or a DNS lookup.
+func (p *pushNotifier) resolvesTo(host string, addr netip.Addr) bool {
+	host = normalizePeerName(host)
+	if host == "" || !addr.IsValid() {
+		return false
+	}
+	if literal, err := netip.ParseAddr(host); err == nil {
+		return literal.Unmap() == addr
+	}
+	for _, peer := range p.server.discovery.Peers() {
+		peerAddr, err := netip.ParseAddr(peer.Address)
+		if err != nil || peerAddr.Unmap() != addr {
+			continue
+		}
+		for _, name := range []string{peer.Hostname, peer.FQDN, peer.MachineName} {
+			if name != "" && normalizePeerName(name) == host {
+				return true
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.server.Config().Discovery.DNSTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// device returns the push device of host, looking it up by the names of
+// the peer in the peer table too.
+func (p *pushNotifier) device(host string) (name, id string) {
+	names := []string{host}
+	for _, peer := range p.server.discovery.Peers() {
+		if peer.Address == host || strings.EqualFold(strings.TrimSuffix(peer.Hostname, "."), host) {
+			names = append(names, peer.Address, peer.Hostname, peer.FQDN, peer.MachineName)
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, name := range names {
+		if id := p.devices[normalizePeerName(name)]; id != "" {
+			return name, id
+		}
+	}
+	return "", ""
+}
+
+// wake asks pnserver to wake peer, an outbox address. It returns true if
+// the push was sent, so the peer may connect soon.
+func (p *pushNotifier) wake(ctx context.Context, peer string) bool {
+	cfg := &p.server.Config().Push
+	if cfg.URL == "" {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(peer)
+	name, id := p.device(host)
+	if id == "" {
+		return false
+	}
+	p.mutex.Lock()
+	if time.Now().Before(p.next[id]) {
+		p.mutex.Unlock()
+		return false
+	}
+	p.next[id] = time.Now().Add(pushRateLimit)
+	p.mutex.Unlock()
+
+	senderHostname := cfg.SenderHostname
+	if senderHostname == "" {
+		senderHostname, _ = os.Hostname()
+	}
+	retryAfter, err := p.post(ctx, cfg, &pushRequest{
+		Sender:         cfg.Sender,
+		Receiver:       name,
+		SenderHostname: senderHostname,
+		SenderID:       cfg.SenderID,
+		ReceiverID:     id,
+		MessageType:    "connection_request",
+		Message:        cfg.Message,
+	})
+	if err != nil {
+		p.mutex.Lock()
+		p.next[id] = time.Now().Add(retryAfter)
+		p.mutex.Unlock()
+		p.server.outboxLog.Warn("Push to wake peer failed", "peer", p.server.sensitive(peer), "id", id, "retry_after", retryAfter, "err", err)
+		return false
+	}
+	p.server.outboxLog.Info("Push sent to wake peer", "peer", p.server.sensitive(peer), "id", id)
+	p.server.metrics.pushRequests.Inc("sent")
+	return true
+}
+
+// post sends req to pnserver. On failure, it returns how long to wait
+// before pushing to the device again.
+func (p *pushNotifier) post(ctx context.Context, cfg *PushConfig, req *pushRequest) (time.Duration, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return pushRetryAfterError, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return pushRetryAfterError, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "tailchatd")
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		p.server.metrics.pushRequests.Inc("error")
+		return pushRateLimit, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, pushMaxResponseBytes))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		p.server.metrics.pushRequests.Inc("rate_limited")
+		retryAfter := pushRateLimit
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, fmt.Errorf("rate limited: %s", bytes.TrimSpace(body))
+	default:
+		p.server.metrics.pushRequests.Inc("error")
+		return pushRetryAfterError, fmt.Errorf("unexpected status %v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+}
+
+// validatePushURL checks the pnserver URL, which must be https unless it is
+// on a loopback address.
+func validatePushURL(rawURL string) error {
+	req, err := http.NewRequest(http.MethodPost, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	switch req.URL.Scheme {
+	case "https":
+		return nil
+	case "http":
+		port := req.URL.Port()
+		if port == "" {
+			port = "80"
+		}
+		if isLoopbackAddr(net.JoinHostPort(req.URL.Hostname(), port)) {
+			return nil
+		}
+		return fmt.Errorf("must be https unless on a loopback address: %q", rawURL)
+	default:
+		return fmt.Errorf("must be https: %q", rawURL)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSenderID = "6f1c2a3e-0d4b-4c5a-9e8f-1a2b3c4d5e6f"
+	testDeviceID = "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+)
+
+// testPNServer records the pushes and answers them with status.
+type testPNServer struct {
+	mutex    sync.Mutex
+	requests []pushRequest
+	status   int
+}
+
+func (p *testPNServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req pushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requests = append(p.requests, req)
+	if p.status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "120")
+	}
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+	}
+}
+
+func (p *testPNServer) pushes() []pushRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]pushRequest(nil), p.requests...)
+}
+
+func TestPushWake(t *testing.T) {
+	pn := &testPNServer{}
+	ts := httptest.NewServer(pn)
+	t.Cleanup(ts.Close)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Push.URL = ts.URL
+		cfg.Push.SenderID = testSenderID
+		cfg.Push.SenderHostname = "laptop"
+		cfg.Push.Timeout = 5 * time.Second
+	})
+	s.discovery = testDiscovery{{Address: "100.64.0.7", Hostname: "phone"}}
+	if err := s.push.setDevice("Phone.", testDeviceID); err != nil {
+		t.Fatalf("setDevice: %v", err)
+	}
+
+	// The device is found by the hostname of the peer at the address.
+	if !s.push.wake(context.Background(), "100.64.0.7:50311") {
+		t.Fatal("wake = false, want a push")
+	}
+	pushes := pn.pushes()
+	if len(pushes) != 1 {
+		t.Fatalf("got %d pushes, want 1", len(pushes))
+	}
+	want := pushRequest{
+		Receiver:       "phone",
+		SenderHostname: "laptop",
+		SenderID:       testSenderID,
+		ReceiverID:     testDeviceID,
+		MessageType:    "connection_request",
+		Message:        s.Config().Push.Message,
+	}
+	if pushes[0] != want {
+		t.Errorf("push = %+v, want %+v", pushes[0], want)
+	}
+
+	// The device is not pushed again until the rate limit passed.
+	if s.push.wake(context.Background(), "100.64.0.7:50311") {
+		t.Error("second wake = true, want rate limited")
+	}
+	if n := len(pn.pushes()); n != 1 {
+		t.Errorf("got %d pushes, want 1", n)
+	}
+
+	// A refused push waits for the Retry-After of pnserver.
+	pn.mutex.Lock()
+	pn.status = http.StatusTooManyRequests
+	pn.mutex.Unlock()
+	s.push.mutex.Lock()
+	delete(s.push.next, testDeviceID)
+	s.push.mutex.Unlock()
+	if s.push.wake(context.Background(), "100.64.0.7:50311") {
+		t.Error("refused wake = true, want false")
+	}
+	s.push.mutex.Lock()
+	next := s.push.next[testDeviceID]
+	s.push.mutex.Unlock()
+	if wait := time.Until(next); wait < 100*time.Second || wait > 120*time.Second {
+		t.Errorf("next push in %v, want the 120s of Retry-After", wait)
+	}
+
+	// A peer without a device is not pushed.
+	if s.push.wake(context.Background(), "100.64.0.8:50311") {
+		t.Error("wake of a peer without device = true")
+	}
+}
+
+func TestPushLearn(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.discovery = testDiscovery{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+
+	if s.push.learn(conn, "hello") {
+		t.Error("chat text was taken as a push device")
+	}
+	if !s.push.learn(conn, pnInfoPrefix+"100.64.0.9 "+testDeviceID) {
+		t.Error("announcement for another host was passed on as text")
+	}
+	if devices := s.push.list(); len(devices) != 0 {
+		t.Errorf("devices = %v, want none for another host", devices)
+	}
+	if !s.push.learn(conn, pnInfoPrefix+"127.0.0.1 "+testDeviceID) {
+		t.Error("announcement was passed on as text")
+	}
+	if id := s.push.list()["127.0.0.1"]; id != testDeviceID {
+		t.Errorf("device = %q, want %q", id, testDeviceID)
+	}
+
+	// The devices are saved and loaded again after a restart.
+	restarted := newPushNotifier(s)
+	restarted.load()
+	if id := restarted.list()["127.0.0.1"]; id != testDeviceID {
+		t.Errorf("device after a restart = %q, want %q", id, testDeviceID)
+	}
+}
+
+func TestValidatePushURL(t *testing.T) {
+	for url, ok := range map[string]bool{
+		"https://cylonix.io/apn/tailchat": true,
+		"http://127.0.0.1:8080/apn":       true,
+		"http://localhost/apn":            true,
+		"http://cylonix.io/apn/tailchat":  false,
+		"ftp://cylonix.io/apn":            false,
+	} {
+		if err := validatePushURL(url); (err == nil) != ok {
+			t.Errorf("validatePushURL(%q) = %v, want ok %v", url, err, ok)
+		}
+	}
+}
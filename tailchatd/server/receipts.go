@@ -0,0 +1,305 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"cylonix.io/tailchatd/events"
+)
+
+// Receipts tell the sender of a message what became of it beyond the ACK of
+// the daemon. They are sent back to the sender through the outbox as
+// "RECEIPT:<receipt id>:<message id>:<status>" and passed to its subscribers
+// as "RECEIPT:<message id>:<json ReceiptEvent>". Subscribers report that a
+// message was shown with "READ:<message id>[:<peer address>]".
+const (
+	receiptPrefix = "RECEIPT:"
+	readPrefix    = "READ:"
+
+	rejectInvalidReceipt = "invalid_receipt"
+
+	// ReceiptDelivered is sent once a subscriber has taken the message.
+	ReceiptDelivered = "delivered"
+	// ReceiptRead is sent once a subscriber reported the message as shown.
+	ReceiptRead = "read"
+
+	// receiptsMaxOrigins limits the received messages remembered for their
+	// receipts. The oldest are forgotten first.
+	receiptsMaxOrigins = 10000
+
+	// receiptsSaveDelay is how long the changes to the origins are gathered
+	// before they are saved.
+	receiptsSaveDelay = 2 * time.Second
+)
+
+// ReceiptOrigin is where a received message came from, kept until its
+// receipts are queued.
+type ReceiptOrigin struct {
+	ID        string    `json:"id"`   // Message id.
+	Peer      string    `json:"peer"` // Outbox address of the sender.
+	Group     string    `json:"group,omitempty"`
+	Received  time.Time `json:"received"`
+	Delivered bool      `json:"delivered,omitempty"` // The delivered receipt was queued.
+}
+
+// ReceiptEvent is passed to the subscribers when a peer sends a receipt.
+type ReceiptEvent struct {
+	Status string `json:"status"` // delivered or read
+	Peer   string `json:"peer"`   // Address of the peer that sent the receipt.
+}
+
+// receiptTracker remembers the origins of the received messages and queues
+// their receipts. The receipts are queued in the outbox by a worker, as
+// they are found while the buffer or the outbox reports are locked.
+type receiptTracker struct {
+	server *Server
+
+	mutex     sync.Mutex
+	order     *list.List                          // Origins, oldest first.
+	origins   map[string]map[string]*list.Element // Message id -> peer -> origin.
+	pending   []OutboundMessage                   // Receipts for the worker to queue.
+	dirty     bool                                // The origins changed since they were saved.
+	saveTimer *time.Timer
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReceiptTracker(s *Server) *receiptTracker {
+	return &receiptTracker{
+		server:  s,
+		order:   list.New(),
+		origins: make(map[string]map[string]*list.Element),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// load loads the saved origins.
+func (r *receiptTracker) load() {
+	origins, err := r.server.storage.LoadReceiptOrigins()
+	if err != nil {
+		r.server.chatLog.Error("Failed to load the receipt origins", "err", r.server.redactPath(err))
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, origin := range origins {
+		r.addLocked(origin)
+	}
+}
+
+// start starts the worker queuing the receipts.
+func (r *receiptTracker) start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			select {
+			case <-r.wake:
+				r.queuePending()
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the worker and queues the pending receipts. It is called on
+// shutdown before the outbox is stopped.
+func (r *receiptTracker) stop() {
+	close(r.done)
+	r.wg.Wait()
+	r.queuePending()
+}
+
+// saveLocked saves the origins within receiptsSaveDelay, along with the
+// other changes made until then.
+func (r *receiptTracker) saveLocked() {
+	r.dirty = true
+	if r.saveTimer == nil {
+		r.saveTimer = time.AfterFunc(receiptsSaveDelay, r.flush)
+	}
+}
+
+// flush saves the origins if they changed. It is called on shutdown.
+func (r *receiptTracker) flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.saveTimer != nil {
+		r.saveTimer.Stop()
+		r.saveTimer = nil
+	}
+	if !r.dirty {
+		return
+	}
+	r.dirty = false
+	origins := make([]*ReceiptOrigin, 0, r.order.Len())
+	for e := r.order.Front(); e != nil; e = e.Next() {
+		origins = append(origins, e.Value.(*ReceiptOrigin))
+	}
+	if err := r.server.storage.SaveReceiptOrigins(origins); err != nil {
+		r.server.chatLog.Error("Failed to save the receipt origins", "err", r.server.redactPath(err))
+	}
+}
+
+// addLocked remembers origin as the newest, replacing an origin of the same
+// message from the same peer and forgetting the oldest beyond
+// receiptsMaxOrigins.
+func (r *receiptTracker) addLocked(origin *ReceiptOrigin) {
+	if old := r.getLocked(origin.ID, origin.Peer); old != nil {
+		r.removeLocked(old)
+	}
+	peers := r.origins[origin.ID]
+	if peers == nil {
+		peers = make(map[string]*list.Element)
+		r.origins[origin.ID] = peers
+	}
+	peers[origin.Peer] = r.order.PushBack(origin)
+	for r.order.Len() > receiptsMaxOrigins {
+		r.removeLocked(r.order.Front().Value.(*ReceiptOrigin))
+	}
+}
+
+func (r *receiptTracker) getLocked(id, peer string) *ReceiptOrigin {
+	if e, ok := r.origins[id][peer]; ok {
+		return e.Value.(*ReceiptOrigin)
+	}
+	return nil
+}
+
+func (r *receiptTracker) removeLocked(origin *ReceiptOrigin) {
+	peers := r.origins[origin.ID]
+	if e, ok := peers[origin.Peer]; ok {
+		r.order.Remove(e)
+		delete(peers, origin.Peer)
+	}
+	if len(peers) == 0 {
+		delete(r.origins, origin.ID)
+	}
+}
+
+// track remembers that the message with id came from the peer of conn. It
+// is called before the message is passed to the subscribers.
+func (r *receiptTracker) track(id string, conn net.Conn, group string) {
+	cfg := &r.server.Config().Receipts
+	if !cfg.Delivered && !cfg.Read {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.addLocked(&ReceiptOrigin{
+		ID:       id,
+		Peer:     normalizePeer(remoteAddr(conn).String()),
+		Group:    group,
+		Received: time.Now(),
+	})
+	r.saveLocked()
+}
+
+// delivered queues the delivered receipt of e, an event passed to a
+// subscriber, if it came from a peer.
+func (r *receiptTracker) delivered(e *events.Event) {
+	switch e.Type {
+	case events.Text, events.Ctrl, events.GroupText, events.FileEnd:
+	default:
+		return
+	}
+	if e.Peer == nil || !r.server.Config().Receipts.Delivered {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	origin := r.getLocked(e.ID, normalizePeer(e.Peer.Address))
+	if origin == nil || origin.Delivered {
+		return
+	}
+	origin.Delivered = true
+	r.queueLocked(origin, ReceiptDelivered)
+	if !r.server.Config().Receipts.Read {
+		r.removeLocked(origin)
+	}
+	r.saveLocked()
+}
+
+// read queues the read receipt of the message with id from peer, an
+// address that may be empty if only one peer sent a message with id. The
+// origin is then forgotten.
+func (r *receiptTracker) read(id, peer string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var origin *ReceiptOrigin
+	if peer != "" {
+		origin = r.getLocked(id, normalizePeer(peer))
+	} else if peers := r.origins[id]; len(peers) > 1 {
+		return fmt.Errorf("message %q came from %d peers, the peer must be given", id, len(peers))
+	} else {
+		for _, e := range peers {
+			origin = e.Value.(*ReceiptOrigin)
+		}
+	}
+	if origin == nil {
+		return fmt.Errorf("unknown message %q", id)
+	}
+	r.removeLocked(origin)
+	if r.server.Config().Receipts.Read {
+		r.queueLocked(origin, ReceiptRead)
+	}
+	r.saveLocked()
+	return nil
+}
+
+// queueLocked hands the receipt of origin to the worker.
+func (r *receiptTracker) queueLocked(origin *ReceiptOrigin, status string) {
+	r.pending = append(r.pending, OutboundMessage{
+		ID:   newMessageID(),
+		Peer: origin.Peer,
+		Type: "RECEIPT",
+		Body: origin.ID + ":" + status,
+	})
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queuePending queues the pending receipts in the outbox. It must be called
+// without any lock held, as queuing reports to the subscribers.
+func (r *receiptTracker) queuePending() {
+	r.mutex.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.mutex.Unlock()
+	for _, m := range pending {
+		if _, err := r.server.outbox.add([]OutboundMessage{m}); err != nil {
+			r.server.chatLog.Error("Failed to queue receipt", "body", m.Body, "err", err)
+		}
+	}
+}
+
+// handleReceipt passes a receipt from the peer of conn to the subscribers.
+func (s *Server) handleReceipt(conn net.Conn, message string) error {
+	parts := strings.SplitN(message, ":", 4)
+	if len(parts) < 4 || (parts[3] != ReceiptDelivered && parts[3] != ReceiptRead) {
+		return &rejectedError{rejectInvalidReceipt}
+	}
+	data, err := json.Marshal(ReceiptEvent{Status: parts[3], Peer: remoteAddr(conn).String()})
+	if err != nil {
+		return err
+	}
+	e, err := s.peerEvent(conn, receiptPrefix+parts[2]+":"+string(data))
+	if err != nil {
+		return err
+	}
+	s.broadcastOrBufferEvent(e)
+	return nil
+}
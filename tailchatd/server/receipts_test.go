@@ -0,0 +1,133 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiptCount returns the number of receipts queued in the outbox of s.
+func receiptCount(s *Server) int {
+	count := 0
+	for _, m := range s.outbox.list() {
+		if m.Type == "RECEIPT" {
+			count++
+		}
+	}
+	return count
+}
+
+// TestReceiptsReplayWhileDelivering replays buffered messages, whose
+// delivered receipts are queued, while the outbox reports completed
+// deliveries to the buffer.
+func TestReceiptsReplayWhileDelivering(t *testing.T) {
+	receiver := newTestServer(t, nil)
+	to := serveTestChat(t, receiver)
+	s, _ := newTestOutbox(t, to, func(cfg *Config) {
+		cfg.Receipts.Delivered = true
+		cfg.Limits.MessagesPerSecond = 0
+	})
+	s.receipts.start()
+	t.Cleanup(s.receipts.stop)
+	peer := dialTestPeer(t, serveTestChat(t, s))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serveSubscribers(listener, false)
+
+	const rounds, messages = 5, 20
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 200; i++ {
+			if _, err := s.outbox.enqueue(OutboundMessage{ID: fmt.Sprintf("t%d", i), Peer: to, Type: "TEXT", Body: "hi"}); err != nil {
+				t.Errorf("enqueue: %v", err)
+				return
+			}
+		}
+	}()
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < messages; i++ {
+			id := fmt.Sprintf("m%d-%d", round, i)
+			peer.write("TEXT:" + id + ":hi\n")
+			if reply := peer.reply(); reply != "ACK:"+id+":DONE" {
+				t.Fatalf("reply = %q, want ACK:%v:DONE", reply, id)
+			}
+		}
+		sub := dialTestPeer(t, listener.Addr().String())
+		last := fmt.Sprintf("TEXT:m%d-%d:", round, messages-1)
+		for !strings.HasPrefix(sub.reply(), last) {
+		}
+		sub.conn.Close()
+		for deadline := time.Now().Add(5 * time.Second); len(s.adminSubscribers()) > 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("subscriber not removed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("outbox deliveries stuck")
+	}
+	for deadline := time.Now().Add(5 * time.Second); receiptCount(s) < rounds*messages; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d receipts queued, want %d", receiptCount(s), rounds*messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiptsKeyedByPeer(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Receipts.Read = true
+	})
+	t.Cleanup(s.outbox.stop)
+	conn, _ := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	r := s.receipts
+	track := func(id, addr string) {
+		r.track(id, &addrConn{Conn: conn, remote: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1234}}, "")
+	}
+	track("m1", "100.64.0.1")
+	track("m1", "100.64.0.2")
+	if err := r.read("m1", ""); err == nil {
+		t.Error("READ of an id sent by two peers without the peer succeeded")
+	}
+	if err := r.read("m1", "100.64.0.2"); err != nil {
+		t.Errorf("READ with the peer: %v", err)
+	}
+	if err := r.read("m1", ""); err != nil {
+		t.Errorf("READ of an id sent by one peer: %v", err)
+	}
+	if err := r.read("m1", ""); err == nil {
+		t.Error("second READ succeeded")
+	}
+
+	for i := 0; i < receiptsMaxOrigins+10; i++ {
+		track(fmt.Sprint(i), "100.64.0.1")
+	}
+	if r.order.Len() != receiptsMaxOrigins || r.getLocked("0", "100.64.0.1:50311") != nil || r.getLocked("10", "100.64.0.1:50311") == nil {
+		t.Errorf("%d origins kept, want the newest %d", r.order.Len(), receiptsMaxOrigins)
+	}
+	r.queuePending()
+	if count := receiptCount(s); count != 2 {
+		t.Errorf("%d receipts queued, want 2", count)
+	}
+}
+
+// addrConn is a net.Conn with the remote address set.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
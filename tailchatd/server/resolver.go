@@ -0,0 +1,111 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// MagicDNSAddress is the MagicDNS resolver address served on every tailnet
+// node. It answers PTR queries for tailnet peers even when the host is not
+// using it as the system DNS.
+const MagicDNSAddress = "100.100.100.100"
+
+// peerName is the result of a reverse lookup of a tailnet peer address.
+type peerName struct {
+	FQDN          string // Raw PTR answer, e.g. "host.tail1234.ts.net."
+	MachineName   string // First label of the FQDN, e.g. "host"
+	TailnetDomain string // Remaining labels, e.g. "tail1234.ts.net"
+}
+
+// Hostname returns the FQDN without the trailing '.'.
+func (p peerName) Hostname() string {
+	return strings.TrimSuffix(p.FQDN, ".")
+}
+
+func newPeerName(fqdn string) peerName {
+	name, domain, _ := strings.Cut(strings.TrimSuffix(fqdn, "."), ".")
+	return peerName{
+		FQDN:          fqdn,
+		MachineName:   name,
+		TailnetDomain: domain,
+	}
+}
+
+// hostnameResolver resolves peer addresses to names by trying a chain of DNS
+// servers in order. An empty server in the chain is the system resolver.
+type hostnameResolver struct {
+	servers []string
+	timeout time.Duration
+}
+
+// newHostnameResolver builds the lookup chain. The configured server comes
+// first, followed by MagicDNS if a tailnet interface exists and finally the
+// system resolver.
+func newHostnameResolver(server string, hasTailnet bool, timeout time.Duration) *hostnameResolver {
+	var servers []string
+	if server != "" {
+		servers = append(servers, withDNSPort(server))
+	}
+	if hasTailnet && withDNSPort(server) != withDNSPort(MagicDNSAddress) {
+		servers = append(servers, withDNSPort(MagicDNSAddress))
+	}
+	servers = append(servers, "")
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &hostnameResolver{servers: servers, timeout: timeout}
+}
+
+func withDNSPort(server string) string {
+	if server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+func dnsResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookup returns the name of addr from the first server in the chain that
+// answers. Each query is bounded by the resolver timeout.
+func (r *hostnameResolver) lookup(ctx context.Context, addr string) (peerName, error) {
+	var errs []string
+	for _, server := range r.servers {
+		queryCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		names, err := dnsResolver(server).LookupAddr(queryCtx, addr)
+		cancel()
+		if err == nil && len(names) > 0 {
+			return newPeerName(names[0]), nil
+		}
+		if ctx.Err() != nil {
+			return peerName{}, ctx.Err()
+		}
+		if server == "" {
+			server = "system"
+		}
+		if err == nil {
+			err = fmt.Errorf("no PTR record")
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", server, err))
+	}
+	return peerName{}, fmt.Errorf("lookup %v failed: %v", addr, strings.Join(errs, "; "))
+}
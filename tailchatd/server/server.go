@@ -0,0 +1,441 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package server implements the tailchat daemon: it receives messages and
+// files from tailnet peers on the chat port and passes them to the apps
+// subscribed on the subscriber port, buffering them while no app is
+// connected. A Server has no global state, so several can run in one
+// process.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cylonix.io/tailchatd/lantls"
+)
+
+// Options configure a Server. Only Config is commonly set; the rest default
+// to what tailchatd uses.
+type Options struct {
+	// Config is the initial configuration. Defaults to DefaultConfig().
+	Config *Config
+
+	// Logger is the base logger. Each component logs with a "component"
+	// attribute. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// DebugPayloads logs message bodies, file names and hostnames, which
+	// are redacted otherwise. See also SetDebugPayloads.
+	DebugPayloads bool
+
+	// Storage keeps the received files and the buffered messages. Defaults
+	// to a DirStorage at Config.Storage.
+	Storage Storage
+
+	// Discovery finds the tailnet peers. Defaults to a NetworkMonitor
+	// watching the local interfaces and routes with netlink. The LAN peers
+	// found with mDNS are added if enabled in the config.
+	Discovery Discovery
+
+	// OnMessage is called with each text and control message received from
+	// a peer after it is passed to the subscribers. It runs on the
+	// connection goroutine and delays the ACK to the peer.
+	OnMessage func(Message)
+
+	// OnFileReceived is called with each file received completely. It runs
+	// on the connection goroutine and delays the ACK to the peer.
+	OnFileReceived func(ReceivedFile)
+}
+
+// Message is a text or control message received from a peer.
+type Message struct {
+	Type  string // TEXT or CTRL
+	ID    string
+	Body  string
+	Peer  string // Remote address of the peer connection.
+	Group string // Group conversation of a TEXT message, if any.
+}
+
+// ReceivedFile is a file received from a peer.
+type ReceivedFile struct {
+	ID   string
+	Name string
+	Path string // Where Storage put the file.
+	Size int64
+	Peer string // Remote address of the peer connection.
+
+	Metadata *FileMetadata
+}
+
+// Discovery finds the tailnet peers that are reported to the subscribers.
+type Discovery interface {
+	// Start begins discovery. onPeers is called with the peer table
+	// whenever it changes. onTailnetAddrs, if not nil, is called with the
+	// local tailnet addresses on start and whenever they change.
+	Start(onPeers func([]NetworkInfo), onTailnetAddrs func([]net.IP)) error
+
+	// Peers returns the current peer table.
+	Peers() []NetworkInfo
+
+	// Rescan refreshes the peer table and returns when done.
+	Rescan()
+
+	// Stop ends discovery.
+	Stop()
+}
+
+// Server is a tailchat daemon. Create it with New, then call Start and
+// finally Shutdown.
+type Server struct {
+	opts      Options
+	config    atomic.Pointer[Config]
+	storage   Storage
+	discovery Discovery
+	metrics   *metrics
+	hooks     *hookRunner
+	outbox    *outbox
+	push      *pushNotifier
+	groups    *groupStore
+	receipts  *receiptTracker
+	dedup     *dedupSet
+	offers    *offerTable
+	tlsConfig *tls.Config // Nil if TLS is off.
+	started   time.Time
+
+	// tlsCert and tlsHostPins deliver the outbox over TLS, pinning the keys
+	// of the peers dialed by host.
+	tlsCert     tls.Certificate
+	tlsHostPins *lantls.Pins
+
+	daemonLog     *slog.Logger
+	chatLog       *slog.Logger
+	transferLog   *slog.Logger
+	subscriberLog *slog.Logger
+	networkLog    *slog.Logger
+	hookLog       *slog.Logger
+	outboxLog     *slog.Logger
+	debugPayloads atomic.Bool
+
+	chatListener       net.Listener
+	subscriberListener net.Listener
+	closers            []io.Closer
+
+	// shutdownCtx is canceled when shutdown begins. Idle peer connections
+	// are closed and no new messages are started.
+	shutdownCtx   context.Context
+	beginShutdown context.CancelFunc
+
+	// drainCtx is canceled when the drain deadline passes. In-flight file
+	// transfers are interrupted and checkpointed.
+	drainCtx context.Context
+	endDrain context.CancelFunc
+
+	peerConns     map[net.Conn]*peerConn
+	peerConnMutex sync.Mutex
+	peerConnWG    sync.WaitGroup
+
+	subscribers     map[net.Conn]*subscriber
+	subscriberMutex sync.RWMutex
+	bufferMutex     sync.Mutex
+
+	peerLimiters map[netip.Addr]*peerLimiter
+	admitted     int
+	limiterMutex sync.Mutex
+
+	transfers     map[*transfer]struct{}
+	transferMutex sync.Mutex
+
+	// inspections limits the thumbnails made at once, and inspecting waits
+	// for them on shutdown.
+	inspections chan struct{}
+	inspecting  sync.WaitGroup
+}
+
+// New returns a Server for opts. The config is validated and the storage
+// prepared, but nothing is started.
+func New(opts Options) (*Server, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &Server{
+		opts:          opts,
+		started:       time.Now(),
+		daemonLog:     logger.With("component", ComponentDaemon),
+		chatLog:       logger.With("component", ComponentChat),
+		transferLog:   logger.With("component", ComponentTransfer),
+		subscriberLog: logger.With("component", ComponentSubscriber),
+		networkLog:    logger.With("component", ComponentNetwork),
+		hookLog:       logger.With("component", ComponentHook),
+		outboxLog:     logger.With("component", ComponentOutbox),
+		peerConns:     make(map[net.Conn]*peerConn),
+		subscribers:   make(map[net.Conn]*subscriber),
+		peerLimiters:  make(map[netip.Addr]*peerLimiter),
+		transfers:     make(map[*transfer]struct{}),
+		inspections:   make(chan struct{}, inspectMaxFiles),
+	}
+	s.config.Store(cfg)
+	s.debugPayloads.Store(opts.DebugPayloads)
+	s.shutdownCtx, s.beginShutdown = context.WithCancel(context.Background())
+	s.drainCtx, s.endDrain = context.WithCancel(context.Background())
+	s.metrics = newMetrics(s)
+	s.hooks = newHookRunner(s)
+	s.outbox = newOutbox(s)
+	s.push = newPushNotifier(s)
+	s.groups = newGroupStore(s)
+	s.receipts = newReceiptTracker(s)
+	s.dedup = newDedupSet(s)
+	s.offers = newOfferTable(s)
+
+	s.storage = opts.Storage
+	if s.storage == nil {
+		s.daemonLog.Info("Cache dir", "path", cfg.Storage.CacheDir)
+		storage, err := NewDirStorage(cfg.Storage.CacheDir, cfg.BufferFilePath())
+		if err != nil {
+			return nil, err
+		}
+		s.storage = storage
+	}
+	if cfg.TLS.Mode != TLSModeOff {
+		if err := s.loadTLS(cfg); err != nil {
+			return nil, err
+		}
+	}
+	s.discovery = opts.Discovery
+	if s.discovery == nil {
+		s.discovery = newNetworkMonitor(s)
+	}
+	if cfg.Discovery.LAN.Enabled {
+		lan, err := newMDNSDiscovery(s)
+		if err != nil {
+			return nil, err
+		}
+		s.discovery = newMergedDiscovery(s.discovery, lan)
+	}
+	return s, nil
+}
+
+// Config returns the current config.
+func (s *Server) Config() *Config {
+	return s.config.Load()
+}
+
+// SetDebugPayloads turns logging of message bodies, file names and
+// hostnames on or off.
+func (s *Server) SetDebugPayloads(on bool) {
+	s.debugPayloads.Store(on)
+}
+
+// ChatAddr returns the address of the chat listener, or nil if the chat
+// port is bound to the tailnet addresses only.
+func (s *Server) ChatAddr() net.Addr {
+	if s.chatListener == nil {
+		return nil
+	}
+	return s.chatListener.Addr()
+}
+
+// SubscriberAddr returns the address of the subscriber listener.
+func (s *Server) SubscriberAddr() net.Addr {
+	if s.subscriberListener == nil {
+		return nil
+	}
+	return s.subscriberListener.Addr()
+}
+
+// Start loads the saved state, opens the listeners and starts peer
+// discovery. It returns once the server is accepting connections.
+func (s *Server) Start() error {
+	cfg := s.Config()
+
+	// Load the state before the listeners are opened, so that the first
+	// peers and subscribers are handled with it.
+	s.push.load()
+	s.groups.load()
+	s.receipts.load()
+	s.receipts.start()
+	s.dedup.load()
+	s.outbox.start()
+	s.hooks.start()
+
+	var (
+		listener        io.Closer
+		tailnetListener *tailnetListeners
+	)
+	if cfg.Listen.TailnetOnly {
+		_, port, _ := net.SplitHostPort(cfg.Listen.Chat)
+		s.chatLog.Info("Listening on tailnet addresses only", "port", port)
+		tailnetListener = s.newTailnetListeners(port)
+		listener = tailnetListener
+	} else {
+		chatListener, err := net.Listen("tcp", cfg.Listen.Chat)
+		if err != nil {
+			return fmt.Errorf("error starting server: %w", err)
+		}
+		go s.serveChat(chatListener)
+		s.chatListener = chatListener
+		listener = chatListener
+	}
+
+	var onTailnetAddrs func([]net.IP)
+	if tailnetListener != nil {
+		onTailnetAddrs = tailnetListener.update
+	}
+	if err := s.discovery.Start(s.onPeers, onTailnetAddrs); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to start network discovery: %w", err)
+	}
+
+	subscriberListener, err := net.Listen("tcp", cfg.Listen.Subscriber)
+	if err != nil {
+		listener.Close()
+		s.discovery.Stop()
+		return fmt.Errorf("error starting subscriber server: %w", err)
+	}
+	s.subscriberListener = subscriberListener
+	go s.serveSubscribers(subscriberListener, false)
+
+	s.closers = []io.Closer{listener, subscriberListener}
+	if cfg.Listen.Events != "" {
+		eventsListener, err := net.Listen("tcp", cfg.Listen.Events)
+		if err != nil {
+			s.daemonLog.Error("Events port disabled", "err", err)
+		} else {
+			go s.serveSubscribers(eventsListener, true)
+			s.closers = append(s.closers, eventsListener)
+		}
+	}
+	if cfg.Metrics.Listen != "" {
+		metricsServer, err := s.serveMetrics(cfg.Metrics.Listen)
+		if err != nil {
+			s.daemonLog.Error("Metrics disabled", "err", err)
+		} else {
+			s.closers = append(s.closers, metricsServer)
+		}
+	}
+	if cfg.Admin.Socket != "" {
+		adminServer, err := s.serveAdmin(cfg.Admin.Socket)
+		if err != nil {
+			s.daemonLog.Error("Admin API disabled", "err", err)
+		} else {
+			s.closers = append(s.closers, adminServer)
+		}
+	}
+	return nil
+}
+
+// onPeers sends the updated peer table to the subscribers.
+func (s *Server) onPeers(info []NetworkInfo) {
+	message, err := networkMessage(info)
+	if err != nil {
+		s.networkLog.Error("Failed to marshal network info", "err", err)
+		return
+	}
+	s.broadcastMessage(message)
+	s.outbox.wakePeers(info)
+}
+
+// Reload applies cfg to the running server. Changes to the listen
+// addresses, storage, metrics, admin and TLS sections need a restart; they
+// are reported and keep their current values until then.
+func (s *Server) Reload(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	old := s.Config()
+	c := *cfg
+	if old.Listen != c.Listen {
+		s.daemonLog.Warn("Listen address change requires a restart")
+		c.Listen = old.Listen
+	}
+	if old.Storage != c.Storage {
+		s.daemonLog.Warn("Storage path change requires a restart")
+		c.Storage = old.Storage
+	}
+	if old.Metrics != c.Metrics {
+		s.daemonLog.Warn("Metrics address change requires a restart")
+		c.Metrics = old.Metrics
+	}
+	if old.Admin != c.Admin {
+		s.daemonLog.Warn("Admin socket change requires a restart")
+		c.Admin = old.Admin
+	}
+	if old.Discovery.LAN != c.Discovery.LAN {
+		s.daemonLog.Warn("LAN discovery change requires a restart")
+		c.Discovery.LAN = old.Discovery.LAN
+	}
+	if old.TLS != c.TLS {
+		s.daemonLog.Warn("TLS change requires a restart")
+		c.TLS = old.TLS
+	}
+	for name, changed := range c.changedSections(old) {
+		if changed {
+			s.daemonLog.Info("Applied config change", "section", name)
+		}
+	}
+	s.config.Store(&c)
+	return nil
+}
+
+// Shutdown stops the server in order: stop accepting connections, tell the
+// peers and subscribers, drain the in-flight transfers until ctx is done and
+// checkpoint the ones that did not finish, finish the thumbnails of the
+// received files, let the queued hooks run, stop the outbox deliveries,
+// then save the receipt origins and the seen message ids and flush the
+// message buffer. It returns ctx.Err() if transfers had to be interrupted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.daemonLog.Info("Shutting down server")
+	for _, closer := range s.closers {
+		if err := closer.Close(); err != nil {
+			s.daemonLog.Error("Failed to close listener", "err", err)
+		}
+	}
+
+	s.beginShutdown()
+	s.interruptIdlePeers(false)
+	s.broadcastMessage(shutdownMessage)
+
+	var err error
+	if !s.waitPeerConns(ctx) {
+		err = ctx.Err()
+		s.daemonLog.Warn("Transfers still in progress. Checkpointing", "err", err)
+		s.endDrain()
+		s.interruptIdlePeers(true)
+		waitCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if !s.waitPeerConns(waitCtx) {
+			s.daemonLog.Warn("Some peer connections did not finish in time")
+		}
+		cancel()
+	}
+
+	s.inspecting.Wait()
+	hookCtx, cancel := context.WithTimeout(context.Background(), s.Config().ShutdownTimeout)
+	s.hooks.stop(hookCtx)
+	cancel()
+	s.receipts.stop()
+	s.outbox.stop()
+	s.receipts.flush()
+	s.dedup.flush()
+
+	s.discovery.Stop()
+	s.flushBuffer()
+	s.closeSubscribers()
+	s.daemonLog.Info("Server shutdown gracefully")
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with the default config, storing in a
+// temporary directory and logging nowhere. configure may change the config.
+func newTestServer(t testing.TB, configure func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Storage.CacheDir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := New(Options{
+		Config: cfg,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+// serveTestChat serves the chat port of s on a loopback listener until the
+// test ends, and returns its address.
+func serveTestChat(t testing.TB, s *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serveChat(listener)
+	return listener.Addr().String()
+}
+
+// testPeer is a peer connected to the chat port.
+type testPeer struct {
+	t     testing.TB
+	conn  net.Conn
+	lines *bufio.Reader
+	done  map[string]bool // Messages with a final ACK.
+}
+
+func dialTestPeer(t testing.TB, addr string) *testPeer {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testPeer{t: t, conn: conn, lines: bufio.NewReader(conn), done: make(map[string]bool)}
+}
+
+func (p *testPeer) write(data string) {
+	p.t.Helper()
+	if _, err := io.WriteString(p.conn, data); err != nil {
+		p.t.Fatalf("Write: %v", err)
+	}
+}
+
+// reply returns the next line from the daemon that is not a progress ACK.
+// It fails the test on a progress ACK after the final ACK of the message.
+func (p *testPeer) reply() string {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		line, err := p.lines.ReadString('\n')
+		if err != nil {
+			p.t.Fatalf("Read: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if kind, rest, _ := strings.Cut(line, ":"); kind == "ACK" && !strings.HasSuffix(rest, ":DONE") {
+			if p.done[strings.Split(rest, ":")[0]] {
+				p.t.Fatalf("progress %q after the final ACK", line)
+			}
+			continue
+		}
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(line, "ACK:"), ":DONE"); ok {
+			p.done[id] = true
+		}
+		return line
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// shutdownMessage tells peers and subscribers that the daemon is going away.
+const shutdownMessage = "SHUTDOWN:daemon"
+
+var errTransferInterrupted = errors.New("transfer interrupted by shutdown")
+
+// peerConn tracks a peer connection so that shutdown can tell if it is idle
+// or in the middle of handling a message.
+type peerConn struct {
+	conn        net.Conn
+	since       time.Time
+	shutdownCtx context.Context
+	mutex       sync.Mutex
+	busy        bool
+	messages    int
+}
+
+// trackPeerConn registers conn. It returns false if shutdown has begun.
+func (s *Server) trackPeerConn(conn net.Conn) (*peerConn, bool) {
+	s.peerConnMutex.Lock()
+	defer s.peerConnMutex.Unlock()
+	if s.shutdownCtx.Err() != nil {
+		return nil, false
+	}
+	peer := &peerConn{conn: conn, since: time.Now(), shutdownCtx: s.shutdownCtx}
+	s.peerConns[conn] = peer
+	s.peerConnWG.Add(1)
+	s.metrics.peerConnections.Add(1)
+	return peer, true
+}
+
+func (s *Server) untrackPeerConn(peer *peerConn) {
+	s.peerConnMutex.Lock()
+	delete(s.peerConns, peer.conn)
+	s.peerConnMutex.Unlock()
+	s.peerConnWG.Done()
+	s.metrics.peerConnections.Add(-1)
+}
+
+// setBusy marks the connection as handling a message or not. It returns true
+// if shutdown has begun, in which case the connection should be closed once
+// it is no longer busy.
+func (p *peerConn) setBusy(busy bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.busy = busy
+	if busy {
+		p.messages++
+	}
+	return p.shutdownCtx.Err() != nil
+}
+
+// interruptIdlePeers wakes the idle peer connections blocked on reads so that
+// they can say goodbye and close. Busy connections finish their message first.
+func (s *Server) interruptIdlePeers(all bool) {
+	s.peerConnMutex.Lock()
+	defer s.peerConnMutex.Unlock()
+	for _, peer := range s.peerConns {
+		peer.mutex.Lock()
+		if all || !peer.busy {
+			peer.conn.SetReadDeadline(time.Now())
+		}
+		peer.mutex.Unlock()
+	}
+}
+
+// waitPeerConns waits for the peer connection handlers to finish. It returns
+// false if ctx is done first.
+func (s *Server) waitPeerConns(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.peerConnWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Names of the default buffer file, of the outbox, of the push devices, of
+// the groups, of the receipt origins and of the seen message ids in the
+// DirStorage directory.
+const (
+	bufferFile      = ".tailchat_buffer.json"
+	outboxFile      = ".tailchat_outbox.json"
+	pushDevicesFile = ".tailchat_push_devices.json"
+	groupsFile      = ".tailchat_groups.json"
+	receiptsFile    = ".tailchat_receipts.json"
+	seenIDsFile     = ".tailchat_seen_ids.json"
+)
+
+// filesDir is the subdirectory of the DirStorage directory receiving the
+// files, apart from the state files.
+const filesDir = "files"
+
+// Suffixes of the partial files and of their checkpoints.
+const (
+	partSuffix       = ".part"
+	checkpointSuffix = ".json"
+)
+
+// reservedFileNames are the state files, which a received file must never
+// replace.
+var reservedFileNames = []string{
+	bufferFile, outboxFile, pushDevicesFile, groupsFile, receiptsFile, seenIDsFile,
+}
+
+// Storage keeps the files received from peers, the messages buffered while
+// no subscriber is connected and the outbox. The server serializes the calls
+// to the message and outbox methods.
+type Storage interface {
+	// CreateFile starts receiving the file name.
+	CreateFile(name string) (IncomingFile, error)
+
+	// Usage returns the bytes used by the stored files for the cache quota.
+	Usage() (int64, error)
+
+	// AppendMessages adds messages to the end of the buffer.
+	AppendMessages(messages []string) error
+
+	// LoadMessages returns the buffered messages, oldest first.
+	LoadMessages() ([]string, error)
+
+	// ClearMessages drops the buffered messages.
+	ClearMessages() error
+
+	// Sync flushes the buffered messages to stable storage.
+	Sync() error
+
+	// SaveOutbox replaces the saved outbox with messages.
+	SaveOutbox(messages []OutboundMessage) error
+
+	// LoadOutbox returns the saved outbox, oldest first.
+	LoadOutbox() ([]OutboundMessage, error)
+
+	// SavePushDevices replaces the saved push device UUIDs of the peers,
+	// keyed by peer hostname or address.
+	SavePushDevices(devices map[string]string) error
+
+	// LoadPushDevices returns the saved push device UUIDs of the peers.
+	LoadPushDevices() (map[string]string, error)
+
+	// SaveGroups replaces the saved group conversations with groups.
+	SaveGroups(groups []Group) error
+
+	// LoadGroups returns the saved group conversations.
+	LoadGroups() ([]Group, error)
+
+	// SaveReceiptOrigins replaces the saved origins of the received
+	// messages whose receipts are pending, oldest first.
+	SaveReceiptOrigins(origins []*ReceiptOrigin) error
+
+	// LoadReceiptOrigins returns the saved origins of the received
+	// messages, oldest first.
+	LoadReceiptOrigins() ([]*ReceiptOrigin, error)
+
+	// SaveSeenIDs replaces the saved ids of the messages recently handled
+	// from each peer, keyed by peer address.
+	SaveSeenIDs(peers map[string]*SeenIDs) error
+
+	// LoadSeenIDs returns the saved ids of the recently handled messages.
+	LoadSeenIDs() (map[string]*SeenIDs, error)
+}
+
+// IncomingFile is a file being received. Exactly one of Commit, Checkpoint
+// or Abort is called at the end.
+type IncomingFile interface {
+	io.Writer
+
+	// Commit completes the file and returns its path, which is sent to the
+	// subscribers.
+	Commit() (string, error)
+
+	// Checkpoint keeps the partial file with a record of where the transfer
+	// stopped.
+	Checkpoint(checkpoint *TransferCheckpoint) error
+
+	// Abort discards the partial file.
+	Abort()
+}
+
+// TransferCheckpoint records where an interrupted file transfer stopped.
+type TransferCheckpoint struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Received int64     `json:"received"`
+	Peer     string    `json:"peer"`
+	Time     time.Time `json:"time"`
+}
+
+// DirStorage stores the received files in the "files" subdirectory of a
+// directory and the buffered messages in a file, one per line. Files are
+// received into a ".part" file that is renamed once complete, and
+// checkpointed next to it as JSON. The outbox and the push devices are kept
+// as JSON in the directory.
+type DirStorage struct {
+	dir        string
+	bufferFile string
+}
+
+// NewDirStorage returns a DirStorage in dir, creating it if needed.
+func NewDirStorage(dir, bufferFile string) (*DirStorage, error) {
+	if err := os.MkdirAll(filepath.Join(dir, filesDir), 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	return &DirStorage{dir: dir, bufferFile: bufferFile}, nil
+}
+
+type dirFile struct {
+	*os.File
+	path     string
+	partPath string
+}
+
+// validFileName returns if name is a plain file name, which stays in the
+// directory it is joined to. Hidden names, the state files and the names of
+// partial files and checkpoints are refused.
+func validFileName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") {
+		return false
+	}
+	if strings.HasSuffix(name, partSuffix) || strings.HasSuffix(name, partSuffix+checkpointSuffix) {
+		return false
+	}
+	return !slices.Contains(reservedFileNames, name)
+}
+
+func (d *DirStorage) CreateFile(name string) (IncomingFile, error) {
+	if !validFileName(name) || name == filepath.Base(d.bufferFile) {
+		return nil, errors.New("invalid file name")
+	}
+	path := filepath.Join(d.dir, filesDir, name)
+	file, err := os.Create(path + partSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{File: file, path: path, partPath: path + partSuffix}, nil
+}
+
+func (f *dirFile) Commit() (string, error) {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.partPath)
+		return "", fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(f.partPath, f.path); err != nil {
+		os.Remove(f.partPath)
+		return "", err
+	}
+	return f.path, nil
+}
+
+func (f *dirFile) Checkpoint(checkpoint *TransferCheckpoint) error {
+	f.File.Close()
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.partPath+checkpointSuffix, data, 0644)
+}
+
+func (f *dirFile) Abort() {
+	f.File.Close()
+	os.Remove(f.partPath)
+}
+
+func (d *DirStorage) Usage() (int64, error) {
+	var used int64
+	err := filepath.WalkDir(filepath.Join(d.dir, filesDir), func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		used += info.Size()
+		return nil
+	})
+	return used, err
+}
+
+func (d *DirStorage) AppendMessages(messages []string) error {
+	file, err := os.OpenFile(d.bufferFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening buffer file: %w", err)
+	}
+	defer file.Close()
+	for _, message := range messages {
+		if _, err := file.WriteString(message + "\n"); err != nil {
+			return fmt.Errorf("error writing to buffer file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *DirStorage) LoadMessages() ([]string, error) {
+	var messages []string
+	file, err := os.Open(d.bufferFile)
+	if os.IsNotExist(err) {
+		return messages, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening buffered message file: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		messages = append(messages, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading buffered messages file: %w", err)
+	}
+	return messages, nil
+}
+
+func (d *DirStorage) ClearMessages() error {
+	err := os.Truncate(d.bufferFile, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error truncating buffered message file: %w", err)
+	}
+	return nil
+}
+
+func (d *DirStorage) Sync() error {
+	file, err := os.OpenFile(d.bufferFile, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening buffer file for flushing: %w", err)
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// writeJSON atomically replaces the file name in the directory with v as
+// JSON.
+func (d *DirStorage) writeJSON(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.dir, name+".*")
+	if err != nil {
+		return fmt.Errorf("error creating %v: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %v: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error flushing %v: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, name))
+}
+
+// readJSON reads the file name in the directory into v. A missing file
+// leaves v as is.
+func (d *DirStorage) readJSON(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %v: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %v: %w", name, err)
+	}
+	return nil
+}
+
+func (d *DirStorage) SaveOutbox(messages []OutboundMessage) error {
+	return d.writeJSON(outboxFile, messages)
+}
+
+func (d *DirStorage) LoadOutbox() ([]OutboundMessage, error) {
+	var messages []OutboundMessage
+	if err := d.readJSON(outboxFile, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (d *DirStorage) SavePushDevices(devices map[string]string) error {
+	return d.writeJSON(pushDevicesFile, devices)
+}
+
+func (d *DirStorage) LoadPushDevices() (map[string]string, error) {
+	devices := make(map[string]string)
+	if err := d.readJSON(pushDevicesFile, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (d *DirStorage) SaveGroups(groups []Group) error {
+	return d.writeJSON(groupsFile, groups)
+}
+
+func (d *DirStorage) LoadGroups() ([]Group, error) {
+	var groups []Group
+	if err := d.readJSON(groupsFile, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (d *DirStorage) SaveReceiptOrigins(origins []*ReceiptOrigin) error {
+	return d.writeJSON(receiptsFile, origins)
+}
+
+func (d *DirStorage) LoadReceiptOrigins() ([]*ReceiptOrigin, error) {
+	var origins []*ReceiptOrigin
+	if err := d.readJSON(receiptsFile, &origins); err != nil {
+		return nil, err
+	}
+	return origins, nil
+}
+
+func (d *DirStorage) SaveSeenIDs(peers map[string]*SeenIDs) error {
+	return d.writeJSON(seenIDsFile, peers)
+}
+
+func (d *DirStorage) LoadSeenIDs() (map[string]*SeenIDs, error) {
+	peers := make(map[string]*SeenIDs)
+	if err := d.readJSON(seenIDsFile, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
@@ -0,0 +1,614 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cylonix.io/tailchatd/events"
+)
+
+// subscriberMaxLineSize bounds the lines read from a subscriber.
+const subscriberMaxLineSize = 2 * 1024 * 1024
+
+// Rejection reasons of the HELLO and the commands of a subscriber.
+const (
+	rejectUnsupportedVersion = "unsupported_version"
+	rejectUnsupportedFormat  = "unsupported_format"
+	rejectForbidden          = "forbidden"
+	rejectHelloRequired      = "hello_required"
+
+	// eventsHelloTimeout is how long a subscriber of the events port may
+	// take to send its HELLO.
+	eventsHelloTimeout = 10 * time.Second
+)
+
+// subscriber is a connected app that is sent the messages.
+type subscriber struct {
+	conn   net.Conn
+	stop   chan struct{} // Buffered, so that a writer never blocks on it.
+	since  time.Time
+	format string // events.FormatLegacy or events.FormatJSON.
+
+	mutex sync.Mutex // Orders the writes with their sequence numbers.
+	seq   uint64     // Sequence number of the last JSON event written.
+}
+
+// serveSubscribers accepts subscriber connections on listener until it is
+// closed. The subscribers of the events port must send a HELLO first.
+func (s *Server) serveSubscribers(listener net.Listener, events bool) {
+	s.subscriberLog.Info("Starting subscriber server", "addr", listener.Addr().String())
+	var backoff acceptBackoff
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.subscriberLog.Error("Error accepting subscriber connection", "err", err, "backoff", backoff.wait())
+			continue
+		}
+		backoff.reset()
+		go s.handleSubscriberConnection(conn, events)
+	}
+}
+
+// subscriberList returns a snapshot of the connected subscribers.
+func (s *Server) subscriberList() []*subscriber {
+	s.subscriberMutex.RLock()
+	defer s.subscriberMutex.RUnlock()
+	subs := make([]*subscriber, 0, len(s.subscribers))
+	for _, sub := range s.subscribers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// hasSubscribers returns if a subscriber is connected.
+func (s *Server) hasSubscribers() bool {
+	s.subscriberMutex.RLock()
+	defer s.subscriberMutex.RUnlock()
+	return len(s.subscribers) > 0
+}
+
+// stopSubscriber asks the connection of sub to close, without waiting.
+func (sub *subscriber) stopSubscriber() {
+	select {
+	case sub.stop <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) deleteSubscriber(conn net.Conn) {
+	s.subscriberLog.Info("Deleting subscriber", "remote", conn.RemoteAddr().String())
+	s.subscriberMutex.Lock()
+	delete(s.subscribers, conn)
+	s.subscriberMutex.Unlock()
+}
+
+// networkMessage returns the NETWORK message with the peer table.
+func networkMessage(info []NetworkInfo) (string, error) {
+	v, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("NETWORK:%s", string(v)), nil
+}
+
+func (s *Server) handleSubscriberConnection(conn net.Conn, helloRequired bool) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	s.subscriberLog.Info("New subscriber connected", "remote", remote, "events", helloRequired)
+
+	cfg := &s.Config().Subscribers
+	sub := &subscriber{conn: conn, stop: make(chan struct{}, 1), since: time.Now(), format: cfg.Format}
+	timeout := cfg.HelloTimeout
+	if helloRequired {
+		timeout = eventsHelloTimeout
+	}
+	pending, err := s.negotiateFormat(sub, timeout, helloRequired)
+	if err != nil {
+		s.subscriberLog.Info("Error reading HELLO from subscriber", "remote", remote, "err", err)
+		return
+	}
+
+	message, err := networkMessage(s.discovery.Peers())
+	if err != nil {
+		s.subscriberLog.Error("Failed to marshal network info", "err", err)
+		return
+	}
+	if err := s.sendMessage(sub, message); err != nil {
+		s.subscriberLog.Error("Error sending network info to new subscriber", "remote", remote, "err", err)
+		return
+	}
+
+	// The buffered messages are sent and the subscriber added under the
+	// buffer lock, so that each message is either buffered before or
+	// broadcast after.
+	s.bufferMutex.Lock()
+	err = s.sendBufferedMessagesLocked(sub)
+	if err == nil {
+		s.subscriberMutex.Lock()
+		s.subscribers[conn] = sub
+		s.subscriberMutex.Unlock()
+	}
+	s.bufferMutex.Unlock()
+	if err != nil {
+		s.subscriberLog.Error("Closing subscriber connection", "remote", remote, "err", err)
+		return
+	}
+	defer s.deleteSubscriber(conn)
+	pending = s.handleSubscriberLines(sub, pending)
+	buf := make([]byte, 4096)
+	for {
+		select {
+		case <-sub.stop:
+			s.subscriberLog.Info("Stopping signal received. Closing", "remote", remote)
+			return
+		default:
+			// Read from the connection with a timeout
+			conn.SetReadDeadline(time.Now().Add(time.Second)) // Set a timeout to prevent blocking
+			n, err := conn.Read(buf)
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					continue // Timeout occurred, continue reading
+				}
+				s.subscriberLog.Info("Error reading from subscriber", "remote", remote, "err", err)
+				return
+			}
+			if n > 0 {
+				s.subscriberLog.Debug("Received from subscriber", "remote", remote, "data", s.sensitive(string(buf[:n])))
+			}
+			pending = s.handleSubscriberLines(sub, append(pending, buf[:n]...))
+			if len(pending) > subscriberMaxLineSize {
+				s.subscriberLog.Warn("Subscriber line too long. Closing", "remote", remote, "len", len(pending))
+				return
+			}
+		}
+	}
+}
+
+// handleSubscriberLines handles the complete lines of pending and returns
+// the rest.
+func (s *Server) handleSubscriberLines(sub *subscriber, pending []byte) []byte {
+	for {
+		i := bytes.IndexByte(pending, '\n')
+		if i < 0 {
+			return pending
+		}
+		s.handleSubscriberLine(sub, string(pending[:i]))
+		pending = pending[i+1:]
+	}
+}
+
+// negotiateFormat reads the HELLO event a subscriber may send first,
+// waiting for it up to timeout, and answers it. It returns what was read
+// besides the HELLO, to handle as commands. If the HELLO is required, as on
+// the events port, a subscriber not sending it or not getting JSON events is
+// refused.
+func (s *Server) negotiateFormat(sub *subscriber, timeout time.Duration, required bool) ([]byte, error) {
+	if timeout <= 0 {
+		return nil, nil
+	}
+	pending, ok, err := s.readHello(sub, timeout, required)
+	if err != nil || !required {
+		return pending, err
+	}
+	if !ok {
+		s.sendMessage(sub, errorMessage(events.Hello, rejectHelloRequired))
+		return nil, errors.New("no HELLO on the events port")
+	}
+	if sub.format != events.FormatJSON {
+		return nil, errors.New("HELLO refused on the events port")
+	}
+	return pending, nil
+}
+
+// readHello reads the first line of a subscriber, waiting for it up to
+// timeout, and answers it if it is a HELLO. Legacy events are refused if
+// jsonOnly is set. It returns what was read besides the HELLO and if there
+// was one.
+func (s *Server) readHello(sub *subscriber, timeout time.Duration, jsonOnly bool) ([]byte, bool, error) {
+	var pending []byte
+	buf := make([]byte, 4096)
+	sub.conn.SetReadDeadline(time.Now().Add(timeout))
+	for bytes.IndexByte(pending, '\n') < 0 {
+		n, err := sub.conn.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			return pending, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if len(pending) > subscriberMaxLineSize {
+			return nil, false, fmt.Errorf("line too long: %v", len(pending))
+		}
+	}
+	line, rest, _ := bytes.Cut(pending, []byte("\n"))
+	if !events.IsEvent(line) {
+		return pending, false, nil
+	}
+	e, err := events.Decode(line)
+	if err != nil || e.Type != events.Hello {
+		return pending, false, nil
+	}
+
+	remote := sub.conn.RemoteAddr().String()
+	var hello events.HelloPayload
+	if len(e.Payload) > 0 {
+		if err := e.DecodePayload(&hello); err != nil {
+			s.subscriberLog.Warn("Invalid HELLO from subscriber", "remote", remote, "err", err)
+			return rest, true, s.sendMessage(sub, errorMessage(events.Hello, rejectUnsupportedFormat))
+		}
+	}
+	switch {
+	case hello.Format == events.FormatLegacy && !jsonOnly:
+		sub.format = events.FormatLegacy
+	case hello.Format == events.FormatJSON, hello.Format == "":
+		if len(hello.Versions) > 0 && !slices.Contains(hello.Versions, events.Version) {
+			s.subscriberLog.Warn("Unsupported event versions from subscriber", "remote", remote, "versions", hello.Versions)
+			sub.format = events.FormatLegacy
+			return rest, true, s.sendMessage(sub, errorMessage(events.Hello, rejectUnsupportedVersion))
+		}
+		sub.format = events.FormatJSON
+		reply, err := events.New(events.Hello, "", events.HelloPayload{Format: events.FormatJSON, Version: events.Version})
+		if err != nil {
+			return nil, false, err
+		}
+		if err := s.sendEvent(sub, reply); err != nil {
+			return nil, false, err
+		}
+	default:
+		s.subscriberLog.Warn("Unsupported event format from subscriber", "remote", remote, "format", hello.Format)
+		return rest, true, s.sendMessage(sub, errorMessage(events.Hello, rejectUnsupportedFormat))
+	}
+	s.subscriberLog.Info("Subscriber format negotiated", "remote", remote, "format", sub.format)
+	return rest, true, nil
+}
+
+// handleSubscriberLine handles a line from a subscriber. SEND is understood
+// as "SEND:<id>:<json>" with the peer or group, type, body, path and name of
+// an OutboundMessage, GROUP_SET as "GROUP_SET:<group id>:<json>" with the
+// name and members of a Group, READ as "READ:<id>[:<peer address>]" for a
+// received message shown to the user, with the peer if several peers sent
+// the id, and ACCEPT and REJECT as "ACCEPT:<id>" and "REJECT:<id>" for a
+// file offer. The commands may be JSON events in either format. They are
+// accepted from loopback subscribers only, as they act on behalf of the
+// user; others are answered with a forbidden error. Other lines are ignored.
+func (s *Server) handleSubscriberLine(sub *subscriber, line string) {
+	conn := sub.conn
+	if events.IsEvent([]byte(line)) {
+		e, err := events.Decode([]byte(line))
+		if err == nil && e.Type == events.Hello {
+			err = errors.New("HELLO must be the first line")
+		}
+		if err == nil {
+			line, err = events.Legacy(e)
+		}
+		if err != nil {
+			s.subscriberLog.Warn("Ignoring event from subscriber", "remote", conn.RemoteAddr().String(), "err", err)
+			return
+		}
+	}
+	if !remoteAddr(conn).IsLoopback() {
+		kind, rest, _ := strings.Cut(line, ":")
+		switch kind + ":" {
+		case acceptPrefix, rejectPrefix, readPrefix, groupSetPrefix, sendPrefix:
+			id, _, _ := strings.Cut(rest, ":")
+			s.subscriberLog.Warn("Refusing command from non-loopback subscriber", "remote", conn.RemoteAddr().String(), "type", kind, "id", id)
+			s.sendMessage(sub, errorMessage(id, rejectForbidden))
+		}
+		return
+	}
+	if id, ok := strings.CutPrefix(line, acceptPrefix); ok {
+		if err := s.offers.decide(id, true); err != nil {
+			s.subscriberLog.Warn("Ignoring ACCEPT from subscriber", "remote", conn.RemoteAddr().String(), "id", id, "err", err)
+		}
+		return
+	}
+	if id, ok := strings.CutPrefix(line, rejectPrefix); ok {
+		if err := s.offers.decide(id, false); err != nil {
+			s.subscriberLog.Warn("Ignoring REJECT from subscriber", "remote", conn.RemoteAddr().String(), "id", id, "err", err)
+		}
+		return
+	}
+	if rest, ok := strings.CutPrefix(line, readPrefix); ok {
+		id, peer, _ := strings.Cut(rest, ":")
+		if err := s.receipts.read(id, peer); err != nil {
+			s.subscriberLog.Debug("Ignoring READ from subscriber", "remote", conn.RemoteAddr().String(), "id", id, "err", err)
+		}
+		return
+	}
+	if strings.HasPrefix(line, groupSetPrefix) {
+		s.handleGroupSet(sub, strings.TrimPrefix(line, groupSetPrefix))
+		return
+	}
+	if !strings.HasPrefix(line, sendPrefix) {
+		return
+	}
+	id, body, _ := strings.Cut(strings.TrimPrefix(line, sendPrefix), ":")
+	var m OutboundMessage
+	err := json.Unmarshal([]byte(body), &m)
+	if err == nil {
+		m.ID = id
+		m, err = s.outbox.enqueue(m)
+	}
+	if err != nil {
+		s.subscriberLog.Warn("Invalid SEND from subscriber", "remote", conn.RemoteAddr().String(), "id", id, "err", err)
+		data, _ := json.Marshal(OutboundStatus{Status: OutboundFailed, Peer: m.Peer, Error: err.Error()})
+		s.sendMessage(sub, sendStatusPrefix+id+":"+string(data))
+	}
+}
+
+// handleGroupSet creates or changes a group for a subscriber. The group is
+// passed to the subscribers as a GROUP event, or an invalid_group error is
+// replied.
+func (s *Server) handleGroupSet(sub *subscriber, line string) {
+	id, body, _ := strings.Cut(line, ":")
+	var group Group
+	err := json.Unmarshal([]byte(body), &group)
+	if err == nil {
+		group.ID = id
+		_, err = s.groups.set(group)
+	}
+	if err != nil {
+		s.subscriberLog.Warn("Invalid GROUP_SET from subscriber", "remote", sub.conn.RemoteAddr().String(), "group", id, "err", err)
+		s.sendMessage(sub, errorMessage(id, rejectInvalidGroup))
+	}
+}
+
+// sendEvent writes e to sub in its format.
+func (s *Server) sendEvent(sub *subscriber, e *events.Event) error {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	var line []byte
+	if sub.format == events.FormatJSON {
+		numbered := *e
+		sub.seq++
+		numbered.Seq = sub.seq
+		data, err := events.Encode(&numbered)
+		if err != nil {
+			return err
+		}
+		line = data
+	} else {
+		if e.Type == events.FileMeta && !s.Config().Files.Metadata {
+			// Legacy subscribers without metadata get the path only.
+			return nil
+		}
+		message, err := s.legacyMessage(e)
+		if err != nil {
+			return err
+		}
+		line = []byte(message)
+	}
+	_, err := sub.conn.Write(append(line, '\n'))
+	return err
+}
+
+// sendMessage writes a legacy message to sub in its format.
+func (s *Server) sendMessage(sub *subscriber, message string) error {
+	e, err := s.messageEvent(message)
+	if err != nil {
+		return err
+	}
+	return s.sendEvent(sub, e)
+}
+
+// messageEvent converts a legacy message to an event happening now.
+func (s *Server) messageEvent(message string) (*events.Event, error) {
+	e, err := events.FromLegacy(message)
+	if err != nil {
+		return nil, err
+	}
+	e.Time = time.Now()
+	return e, nil
+}
+
+// peerEvent converts a legacy message from the peer of conn to an event
+// happening now.
+func (s *Server) peerEvent(conn net.Conn, message string) (*events.Event, error) {
+	e, err := s.messageEvent(message)
+	if err != nil {
+		return nil, err
+	}
+	e.Peer = s.peerIdentity(conn)
+	return e, nil
+}
+
+// peerIdentity returns the identity of the peer of conn for the events.
+func (s *Server) peerIdentity(conn net.Conn) *events.Peer {
+	addr := remoteAddr(conn)
+	return &events.Peer{Address: addr.String(), Hostname: s.peerHostname(addr)}
+}
+
+// legacyMessage converts e to a legacy message. FILE_END has the metadata
+// of the file instead of its path if files.metadata is set.
+func (s *Server) legacyMessage(e *events.Event) (string, error) {
+	if e.Type == events.FileEnd && s.Config().Files.Metadata {
+		return e.Type + ":" + e.ID + ":" + string(e.Payload), nil
+	}
+	return events.Legacy(e)
+}
+
+func (s *Server) broadcastMessage(message string) {
+	e, err := s.messageEvent(message)
+	if err != nil {
+		s.subscriberLog.Error("Invalid message", "err", err, s.messageAttr(message))
+		return
+	}
+	s.broadcastEvent(e)
+}
+
+func (s *Server) broadcastOrBufferMessage(message string) {
+	e, err := s.messageEvent(message)
+	if err != nil {
+		s.subscriberLog.Error("Invalid message", "err", err, s.messageAttr(message))
+		return
+	}
+	s.broadcastOrBufferEvent(e)
+}
+
+func (s *Server) broadcastEvent(e *events.Event) {
+	s.sendToSubscribers(s.subscriberList(), e)
+}
+
+// sendToSubscribers writes e to subs, stopping those that fail.
+func (s *Server) sendToSubscribers(subs []*subscriber, e *events.Event) {
+	if len(subs) == 0 {
+		return
+	}
+	s.subscriberLog.Debug("Broadcasting message", s.eventAttr(e))
+	sent := false
+	for _, sub := range subs {
+		remote := sub.conn.RemoteAddr().String()
+		if err := s.sendEvent(sub, e); err != nil {
+			s.subscriberLog.Error("Error writing to subscriber socket", "remote", remote, "err", err)
+			sub.stopSubscriber()
+			continue
+		}
+		sent = true
+		s.subscriberLog.Debug("Message sent", "remote", remote)
+	}
+	if sent {
+		s.receipts.delivered(e)
+	}
+}
+
+// broadcastOrBufferEvent passes e to the subscribers, or buffers it until
+// one connects. The buffer holds the events as JSON in any format.
+func (s *Server) broadcastOrBufferEvent(e *events.Event) {
+	s.bufferMutex.Lock()
+	if subs := s.subscriberList(); len(subs) > 0 {
+		s.bufferMutex.Unlock()
+		s.sendToSubscribers(subs, e)
+		return
+	}
+	defer s.bufferMutex.Unlock()
+	s.subscriberLog.Info("No subscriber, buffering message", s.eventAttr(e))
+	data, err := events.Encode(e)
+	if err != nil {
+		s.subscriberLog.Error("Failed to encode buffered message", "err", err, s.eventAttr(e))
+		return
+	}
+	s.appendBufferedMessagesLocked([]string{string(data)})
+	s.trimBufferLocked(s.Config().Buffer.MaxMessages)
+}
+
+// bufferedEvent decodes a buffered message. Messages buffered before the
+// events were buffered as JSON are legacy messages.
+func (s *Server) bufferedEvent(message string) (*events.Event, error) {
+	if events.IsEvent([]byte(message)) {
+		return events.Decode([]byte(message))
+	}
+	return s.messageEvent(message)
+}
+
+// sendBufferedMessagesLocked sends the buffered messages to sub and keeps
+// those that failed.
+func (s *Server) sendBufferedMessagesLocked(sub *subscriber) error {
+	remote := sub.conn.RemoteAddr().String()
+	messages := s.loadBufferedMessagesLocked()
+	var failedMessages []string
+	for index, message := range messages {
+		e, err := s.bufferedEvent(message)
+		if err != nil {
+			s.subscriberLog.Error("Dropping invalid buffered message", "remote", remote, "err", err)
+			continue
+		}
+		if err := s.sendEvent(sub, e); err != nil {
+			s.subscriberLog.Error("Error sending buffered message", "remote", remote, "err", err, s.eventAttr(e))
+			failedMessages = messages[index:]
+			break
+		}
+		s.subscriberLog.Debug("Sending buffered message", "remote", remote, s.eventAttr(e))
+		s.receipts.delivered(e)
+	}
+	s.clearBufferLocked()
+	s.appendBufferedMessagesLocked(failedMessages)
+	if len(failedMessages) > 0 {
+		return fmt.Errorf("failed to send buffered messages to %v failed=%v", remote, len(failedMessages))
+	}
+	return nil
+}
+
+func (s *Server) loadBufferedMessagesLocked() []string {
+	messages, err := s.storage.LoadMessages()
+	if err != nil {
+		s.subscriberLog.Error("Error loading buffered messages", "err", s.redactPath(err))
+		return []string{}
+	}
+	s.subscriberLog.Debug("Buffered messages loaded", "count", len(messages))
+	return messages
+}
+
+func (s *Server) appendBufferedMessagesLocked(messages []string) {
+	if err := s.storage.AppendMessages(messages); err != nil {
+		s.subscriberLog.Error("Error saving buffered messages", "err", s.redactPath(err))
+		return
+	}
+	s.subscriberLog.Debug("Buffered messages saved", "count", len(messages))
+}
+
+func (s *Server) clearBufferLocked() {
+	if err := s.storage.ClearMessages(); err != nil {
+		s.subscriberLog.Error("Error clearing buffered messages", "err", s.redactPath(err))
+		return
+	}
+	s.subscriberLog.Debug("Buffered messages cleared")
+}
+
+// trimBufferLocked drops the oldest buffered messages beyond max.
+func (s *Server) trimBufferLocked(max int) {
+	if max <= 0 {
+		return
+	}
+	messages := s.loadBufferedMessagesLocked()
+	if len(messages) <= max {
+		return
+	}
+	s.subscriberLog.Warn("Buffer limit reached. Dropping oldest messages", "limit", max, "dropped", len(messages)-max)
+	s.clearBufferLocked()
+	s.appendBufferedMessagesLocked(messages[len(messages)-max:])
+}
+
+// bufferStats returns the number of buffered messages and their size.
+func (s *Server) bufferStats() (count int, size int64) {
+	s.bufferMutex.Lock()
+	defer s.bufferMutex.Unlock()
+	messages, err := s.storage.LoadMessages()
+	if err != nil {
+		return 0, 0
+	}
+	for _, message := range messages {
+		size += int64(len(message)) + 1
+	}
+	return len(messages), size
+}
+
+// flushBuffer syncs the buffered messages to stable storage.
+func (s *Server) flushBuffer() {
+	s.bufferMutex.Lock()
+	defer s.bufferMutex.Unlock()
+	if err := s.storage.Sync(); err != nil {
+		s.subscriberLog.Error("Error flushing buffered messages", "err", s.redactPath(err))
+	}
+}
+
+func (s *Server) closeSubscribers() {
+	s.subscriberMutex.Lock()
+	defer s.subscriberMutex.Unlock()
+	for conn := range s.subscribers {
+		conn.Close()
+	}
+}
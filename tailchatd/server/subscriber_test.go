@@ -0,0 +1,101 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"cylonix.io/tailchatd/events"
+)
+
+// serveTestSubscribers serves the subscriber port of s, or its events port,
+// on a loopback listener until the test ends, and returns its address.
+func serveTestSubscribers(t *testing.T, s *Server, events bool) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serveSubscribers(listener, events)
+	return listener.Addr().String()
+}
+
+// event returns the next line passed to sub as an event.
+func (p *testPeer) event() *events.Event {
+	p.t.Helper()
+	line := p.reply()
+	e, err := events.Decode([]byte(line))
+	if err != nil {
+		p.t.Fatalf("invalid event %q: %v", line, err)
+	}
+	return e
+}
+
+func TestLegacySubscriberNotDelayed(t *testing.T) {
+	s := newTestServer(t, nil)
+	sub := dialTestPeer(t, serveTestSubscribers(t, s, false))
+
+	// The peer table comes right away, without waiting for a HELLO.
+	start := time.Now()
+	if line := sub.reply(); !strings.HasPrefix(line, "NETWORK:") {
+		t.Fatalf("line = %q, want NETWORK", line)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("first line after %v", elapsed)
+	}
+}
+
+func TestEventsPort(t *testing.T) {
+	s := newTestServer(t, nil)
+	sub := dialTestPeer(t, serveTestSubscribers(t, s, true))
+	sub.write(`{"v":1,"type":"HELLO","payload":{"format":"json","versions":[1]}}` + "\n")
+	if e := sub.event(); e.Type != events.Hello || e.Seq != 1 {
+		t.Fatalf("event = %+v, want HELLO", e)
+	}
+	if e := sub.event(); e.Type != events.Network || e.Seq != 2 {
+		t.Fatalf("event = %+v, want NETWORK", e)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(s.adminSubscribers()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	peer := dialTestPeer(t, serveTestChat(t, s))
+	peer.write("TEXT:t1:hi\n")
+	peer.reply()
+	e := sub.event()
+	var payload events.MessagePayload
+	if e.Type != events.Text || e.ID != "t1" || e.Peer == nil || e.DecodePayload(&payload) != nil || payload.Body != "hi" {
+		t.Errorf("event = %+v, want TEXT t1 from the peer", e)
+	}
+}
+
+func TestEventsPortRequiresHello(t *testing.T) {
+	s := newTestServer(t, nil)
+	addr := serveTestSubscribers(t, s, true)
+	for _, test := range []struct {
+		first, reply string
+	}{
+		{"READ:m1\n", "ERROR:HELLO:" + rejectHelloRequired},
+		{`{"v":1,"type":"HELLO","payload":{"format":"legacy"}}` + "\n", "ERROR:HELLO:" + rejectUnsupportedFormat},
+		{`{"v":1,"type":"HELLO","payload":{"format":"json","versions":[2]}}` + "\n", "ERROR:HELLO:" + rejectUnsupportedVersion},
+	} {
+		sub := dialTestPeer(t, addr)
+		sub.write(test.first)
+		if line := sub.reply(); line != test.reply {
+			t.Errorf("%q: line = %q, want %q", test.first, line, test.reply)
+		}
+		sub.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadAll(sub.lines); err != nil {
+			t.Errorf("%q: connection not closed: %v", test.first, err)
+		}
+	}
+}
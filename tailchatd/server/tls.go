@@ -0,0 +1,127 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cylonix.io/tailchatd/lantls"
+)
+
+// TLS modes.
+const (
+	TLSModeOff      = "off"
+	TLSModeOptional = "optional"
+	TLSModeRequired = "required"
+)
+
+const rejectTLSRequired = "tls_required"
+
+var errTLSRequired = errors.New("plaintext refused, TLS is required")
+
+// tailnetIPv6Prefix holds the IPv6 addresses of tailnet peers.
+var tailnetIPv6Prefix = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+
+// TLSDir returns where the device certificate and the pinned peer keys are
+// kept.
+func (c *Config) TLSDir() string {
+	return filepath.Join(c.Storage.CacheDir, ".tls")
+}
+
+// loadTLS loads or creates the device certificate and the pins.
+func (s *Server) loadTLS(cfg *Config) error {
+	name := cfg.TLS.Name
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get the device name for TLS: %w", err)
+		}
+		name = hostname
+	}
+	dir := cfg.TLSDir()
+	cert, err := lantls.LoadOrCreateIdentity(dir, name)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS identity: %w", err)
+	}
+	pins, err := lantls.LoadPins(filepath.Join(dir, "known_peers.json"))
+	if err != nil {
+		return err
+	}
+	hostPins, err := lantls.LoadPins(filepath.Join(dir, "known_hosts.json"))
+	if err != nil {
+		return err
+	}
+	s.tlsCert, s.tlsHostPins = cert, hostPins
+	s.tlsConfig = lantls.ServerConfig(cert, pins, func(name, fingerprint string) {
+		s.chatLog.Info("Pinned new peer key", "name", s.sensitive(name), "fingerprint", fingerprint)
+	})
+	s.chatLog.Info("TLS enabled", "mode", cfg.TLS.Mode, "name", s.sensitive(name), "fingerprint", lantls.Fingerprint(cert.Leaf))
+	return nil
+}
+
+// sniffedConn is a connection whose first bytes were read ahead to tell TLS
+// from plaintext.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// negotiate completes the TLS handshake if the peer starts one and returns
+// the connection to use. In required mode, plaintext is refused except from
+// loopback and tailnet addresses. The first byte is waited for at most the
+// idle timeout.
+func (s *Server) negotiate(conn net.Conn) (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return conn, nil
+	}
+	limits := &s.Config().Limits
+	var deadline time.Time
+	if limits.IdleTimeout > 0 {
+		deadline = time.Now().Add(limits.IdleTimeout)
+	}
+	// Shutdown interrupts the read with a past deadline, so check it after
+	// setting ours. The peer is then told in plaintext by the message loop.
+	conn.SetReadDeadline(deadline)
+	r := bufio.NewReader(conn)
+	sniffed := &sniffedConn{Conn: conn, r: r}
+	if s.shutdownCtx.Err() != nil {
+		return sniffed, nil
+	}
+	first, err := r.Peek(1)
+	if err != nil {
+		if s.shutdownCtx.Err() != nil {
+			return sniffed, nil
+		}
+		return nil, err
+	}
+	if first[0] != lantls.HandshakeByte {
+		addr := remoteAddr(conn)
+		if s.Config().TLS.Mode == TLSModeRequired && !addr.IsLoopback() && !isCGNATAddress(addr.String()) && !tailnetIPv6Prefix.Contains(addr) {
+			return nil, errTLSRequired
+		}
+		return sniffed, nil
+	}
+
+	tlsConn := tls.Server(sniffed, s.tlsConfig)
+	if limits.HeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(limits.HeaderTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	s.chatLog.Info("TLS peer", "remote", conn.RemoteAddr().String(), "name", s.sensitive(lantls.PeerName(tlsConn.ConnectionState())))
+	return tlsConn, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var errTransferCanceled = errors.New("transfer canceled")
+
+// transfer tracks an in-progress file transfer so that it can be inspected
+// and canceled through the admin API.
+type transfer struct {
+	ID       string
+	Name     string
+	Size     int64
+	Peer     string
+	Started  time.Time
+	received atomic.Int64
+	canceled bool // Guarded by the server transferMutex.
+	conn     net.Conn
+}
+
+func (s *Server) trackTransfer(conn net.Conn, id, name string, size int64) *transfer {
+	t := &transfer{
+		ID:      id,
+		Name:    name,
+		Size:    size,
+		Peer:    conn.RemoteAddr().String(),
+		Started: time.Now(),
+		conn:    conn,
+	}
+	s.transferMutex.Lock()
+	s.transfers[t] = struct{}{}
+	s.transferMutex.Unlock()
+	return t
+}
+
+// untrackTransfer removes the transfer. It returns errTransferCanceled if the
+// transfer was canceled before, so that a transfer is never both canceled
+// and completed.
+func (s *Server) untrackTransfer(t *transfer) error {
+	s.transferMutex.Lock()
+	defer s.transferMutex.Unlock()
+	delete(s.transfers, t)
+	if t.canceled {
+		return errTransferCanceled
+	}
+	return nil
+}
+
+// transferCanceled returns if the transfer has been canceled.
+func (s *Server) transferCanceled(t *transfer) bool {
+	s.transferMutex.Lock()
+	defer s.transferMutex.Unlock()
+	return t.canceled
+}
+
+// cancelTransfers cancels the in-progress transfers with id and returns how
+// many were canceled. The blocked reads of the transfers are woken up so
+// that they stop and remove their partial files.
+func (s *Server) cancelTransfers(id string) int {
+	s.transferMutex.Lock()
+	defer s.transferMutex.Unlock()
+	n := 0
+	for t := range s.transfers {
+		if t.ID != id || t.canceled {
+			continue
+		}
+		t.canceled = true
+		t.conn.SetReadDeadline(time.Now())
+		n++
+	}
+	return n
+}
+
+// currentTransfers returns the in-progress transfers, oldest first.
+func (s *Server) currentTransfers() []*transfer {
+	s.transferMutex.Lock()
+	defer s.transferMutex.Unlock()
+	list := make([]*transfer, 0, len(s.transfers))
+	for t := range s.transfers {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
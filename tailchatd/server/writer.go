@@ -0,0 +1,175 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// peerWriterQueue is how many control frames may wait for the writer
+	// before the sender blocks.
+	peerWriterQueue = 64
+
+	// peerWriterProgressQueue is how many progress frames may wait for the
+	// writer. More are dropped, as a later one supersedes them.
+	peerWriterProgressQueue = 4
+)
+
+var errWriterClosed = errors.New("peer writer closed")
+
+// frame is one line to write to a peer, without the trailing '\n'.
+type frame struct {
+	line string
+	seq  uint64
+}
+
+// peerWriter owns the writes to a peer connection. Control frames, the
+// final ACKs and the error and shutdown replies, are written in order
+// before the progress ACKs of the file transfers. A progress frame is
+// dropped if a control frame queued after it was already written, so the
+// peer never sees progress after the final ACK.
+type peerWriter struct {
+	conn    net.Conn
+	output  *bufio.Writer
+	timeout time.Duration // Write deadline of each frame. 0 is none.
+
+	seq      atomic.Uint64
+	control  chan frame
+	progress chan frame
+	stop     chan struct{} // Closed by close.
+	done     chan struct{} // Closed when the writer goroutine exits.
+
+	stopOnce sync.Once
+	err      atomic.Pointer[error] // The first write error.
+}
+
+func newPeerWriter(conn net.Conn, timeout time.Duration) *peerWriter {
+	w := &peerWriter{
+		conn:     conn,
+		output:   bufio.NewWriter(conn),
+		timeout:  timeout,
+		control:  make(chan frame, peerWriterQueue),
+		progress: make(chan frame, peerWriterProgressQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// send queues a control frame. It returns the write error if the writer
+// failed.
+func (w *peerWriter) send(line string) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	select {
+	case w.control <- frame{line: line, seq: w.seq.Add(1)}:
+		return nil
+	case <-w.done:
+		if err := w.Err(); err != nil {
+			return err
+		}
+		return errWriterClosed
+	}
+}
+
+// sendProgress queues a progress frame, dropping it if the writer is behind.
+func (w *peerWriter) sendProgress(line string) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	select {
+	case w.progress <- frame{line: line, seq: w.seq.Add(1)}:
+	default:
+	}
+	return nil
+}
+
+// Err returns the first write error.
+func (w *peerWriter) Err() error {
+	if err := w.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// close writes the queued control frames and stops the writer.
+func (w *peerWriter) close() {
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+func (w *peerWriter) run() {
+	defer close(w.done)
+	var written uint64 // Sequence number of the last control frame written.
+	for {
+		var f frame
+		control := true
+		select {
+		case f = <-w.control:
+		default:
+			select {
+			case f = <-w.control:
+			case f = <-w.progress:
+				if f.seq < written {
+					continue
+				}
+				control = false
+			case <-w.stop:
+				w.drain()
+				return
+			}
+		}
+		if !w.write(f) {
+			return
+		}
+		if control {
+			written = f.seq
+		}
+	}
+}
+
+// write writes f, flushing unless more control frames are queued.
+func (w *peerWriter) write(f frame) bool {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	_, err := w.output.WriteString(f.line + "\n")
+	if err == nil && len(w.control) == 0 {
+		err = w.output.Flush()
+	}
+	if err != nil {
+		// Interrupt the reader of the connection, which checks Err after
+		// setting its read deadline.
+		w.err.CompareAndSwap(nil, &err)
+		w.conn.SetReadDeadline(time.Now())
+		return false
+	}
+	return true
+}
+
+// drain writes the control frames queued before close.
+func (w *peerWriter) drain() {
+	for {
+		select {
+		case f := <-w.control:
+			if !w.write(f) {
+				return
+			}
+		default:
+			if w.timeout > 0 {
+				w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+			}
+			w.output.Flush()
+			return
+		}
+	}
+}
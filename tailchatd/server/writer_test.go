@@ -0,0 +1,148 @@
+// Copyright (c) EZBLOCK Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readLines returns the lines read from conn until it is closed.
+func readLines(conn net.Conn) <-chan []string {
+	result := make(chan []string, 1)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		result <- lines
+	}()
+	return result
+}
+
+func TestPeerWriterConcurrentSenders(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	lines := readLines(client)
+	w := newPeerWriter(server, time.Second)
+
+	// Each sender writes its own kind of control frame, numbered in order.
+	const perSender = 200
+	senders := []string{"ACK", "ERROR", "CTRL"}
+	var wg sync.WaitGroup
+	for _, kind := range senders {
+		wg.Add(1)
+		go func(kind string) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				if err := w.send(fmt.Sprintf("%s:%d:%s", kind, i, kind)); err != nil {
+					t.Errorf("send %v %v: %v", kind, i, err)
+					return
+				}
+			}
+		}(kind)
+	}
+	wg.Wait()
+	w.close()
+	server.Close()
+
+	next := make(map[string]int)
+	for _, line := range <-lines {
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || parts[0] != parts[2] {
+			t.Fatalf("garbled line %q", line)
+		}
+		if i, _ := strconv.Atoi(parts[1]); i != next[parts[0]] {
+			t.Fatalf("line %q out of order, want %v", line, next[parts[0]])
+		}
+		next[parts[0]]++
+	}
+	for _, kind := range senders {
+		if next[kind] != perSender {
+			t.Errorf("got %v %v frames, want %v", next[kind], kind, perSender)
+		}
+	}
+}
+
+func TestPeerWriterNoProgressAfterFinal(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	lines := readLines(client)
+	w := newPeerWriter(server, time.Second)
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; !stop.Load(); i++ {
+			w.sendProgress(fmt.Sprintf("ACK:f1:%d", i))
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+	if err := w.send("ACK:f1:DONE"); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+	server.Close()
+
+	final := false
+	for _, line := range <-lines {
+		if line == "ACK:f1:DONE" {
+			final = true
+		} else if final {
+			t.Fatalf("progress %q after the final ACK", line)
+		}
+	}
+	if !final {
+		t.Fatal("no final ACK")
+	}
+}
+
+func TestPeerWriterError(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	w := newPeerWriter(server, 50*time.Millisecond)
+	defer w.close()
+
+	// Nobody reads, so the write times out and interrupts the reader.
+	if err := w.send("ACK:m1:DONE"); err != nil {
+		t.Fatal(err)
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("read error = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader not interrupted")
+	}
+	if w.Err() == nil {
+		t.Fatal("no write error")
+	}
+	if err := w.send("ACK:m2:DONE"); err == nil {
+		t.Error("send succeeded after a write error")
+	}
+	if err := w.sendProgress("ACK:f1:1"); err == nil {
+		t.Error("sendProgress succeeded after a write error")
+	}
+	client.Close()
+}